@@ -0,0 +1,164 @@
+// Command pif-driver lints, inspects and tests hardware descriptors offline
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/op/go-logging"
+	"github.com/opencaps/pif/driver"
+)
+
+const usage = `usage: pif-driver [-v] <command> [arguments]
+
+commands:
+  lint <file>...           validate hardware descriptors and run their test vectors
+  show <file>              print the resolved driver item
+  decode <file> <frame>    run the read translation on a frame
+  encode <file> <value>    run the write translation on a value
+  path <id> <version>      print the file used to store the driver item
+`
+
+func main() {
+	verbose := flag.Bool("v", false, "print the driver package logs")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if !*verbose {
+		logging.SetLevel(logging.WARNING, "dbus-adapter")
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "lint":
+		err = lint(args)
+	case "show":
+		err = withDriver(args, 1, func(d *driver.DriverItem, _ []string) error {
+			show(d)
+			return nil
+		})
+	case "decode":
+		err = withDriver(args, 2, func(d *driver.DriverItem, args []string) error {
+			fmt.Println(d.Read.Translate(driver.ParseValue(args[0])))
+			return nil
+		})
+	case "encode":
+		err = withDriver(args, 2, func(d *driver.DriverItem, args []string) error {
+			fmt.Println(d.Write.Translate(driver.ParseValue(args[0])))
+			return nil
+		})
+	case "path":
+		if len(args) != 2 {
+			flag.Usage()
+			os.Exit(2)
+		}
+		fmt.Println(driver.ItemPath(args[0], args[1]))
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "pif-driver:", err)
+		os.Exit(1)
+	}
+}
+
+func lint(files []string) error {
+	if len(files) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	failed := 0
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+
+		hd, err := driver.ParseHardwareDescriptor(data, true)
+		if err != nil {
+			fmt.Printf("%s: %v\n", file, err)
+			failed++
+			continue
+		}
+
+		errs := hd.Lint()
+		if d, ok := driver.NewDriverItem(*hd); ok {
+			errs = append(errs, d.SelfTest()...)
+		}
+		for _, e := range errs {
+			fmt.Printf("%s: %v\n", file, e)
+		}
+		if len(errs) > 0 {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d descriptors not valid", failed, len(files))
+	}
+	return nil
+}
+
+func withDriver(args []string, nArgs int, fn func(*driver.DriverItem, []string) error) error {
+	if len(args) != nArgs {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	hd, err := driver.LoadHardwareDescriptor(args[0])
+	if err != nil {
+		return err
+	}
+
+	d, ok := driver.NewDriverItem(*hd)
+	if !ok {
+		return fmt.Errorf("unable to generate a driver item from %s", args[0])
+	}
+
+	return fn(d, args[1:])
+}
+
+func show(d *driver.DriverItem) {
+	fmt.Println("Type:         ", d.Type)
+	fmt.Println("IsSensor:     ", d.IsSensor)
+	fmt.Println("PairingNeeded:", d.PairingNeeded)
+	if d.Frequency != nil {
+		fmt.Println("Frequency:    ", *d.Frequency)
+	} else {
+		fmt.Println("Frequency:     none")
+	}
+	showTranslation("Read", &d.Read)
+	showTranslation("Write", &d.Write)
+}
+
+func showTranslation(name string, t *driver.Translation) {
+	fmt.Println(name + ":")
+	fmt.Println("  Field:", t.Field)
+	fmt.Println("  A:    ", t.A)
+	if len(t.Map) == 0 {
+		fmt.Println("  Map:   none")
+		return
+	}
+
+	entries := make([]string, 0, len(t.Map))
+	for key, value := range t.Map {
+		entries = append(entries, fmt.Sprintf("%v (%T) -> %v (%T)", key, key, value, value))
+	}
+	sort.Strings(entries)
+
+	fmt.Println("  Map:")
+	for _, entry := range entries {
+		fmt.Println("   ", entry)
+	}
+}
@@ -6,10 +6,12 @@ import (
 	"os"
 	"reflect"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/op/go-logging"
+	"github.com/opencaps/pif/driver"
 )
 
 const (
@@ -25,6 +27,12 @@ const (
 	callTimeout                = 12 * time.Second
 )
 
+// The backoff of the DeviceManager retries, variables so that it can be shortened
+var (
+	deviceManagerRetryInitial = time.Second
+	deviceManagerRetryMax     = time.Minute
+)
+
 // Dbus exported structure
 type Dbus struct {
 	conn         *dbus.Conn
@@ -32,6 +40,19 @@ type Dbus struct {
 	Bridges      map[string]*BridgeProto
 	ProtocolName string
 	Log          *logging.Logger
+	// Drivers optional drivers manager used to resolve the drivers of the devices and items
+	Drivers *driver.DriversManager
+	// SnapshotPath file where the devices are saved, /data/opencaps/pif/<protocol>.json by default
+	SnapshotPath string
+	// DisableSnapshot disables the local copy used when the DeviceManager is unreachable
+	DisableSnapshot bool
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	snapshotMu    sync.Mutex
+	snapshotTimer *time.Timer
+	snapshotDue   time.Time
 }
 
 type ProtocolJson struct {
@@ -65,6 +86,7 @@ func isNil(i interface{}) bool {
 // InitDbus initialization dbus connection
 func (dc *Dbus) InitDbus(protocolName string, cbs interface{}) *Protocol {
 	dc.ProtocolName = protocolName
+	dc.ctx, dc.cancel = context.WithCancel(context.Background())
 	if dc.Log == nil {
 		dc.Log = logging.MustGetLogger("dbus-adapter")
 	}
@@ -90,78 +112,222 @@ func (dc *Dbus) InitDbus(protocolName string, cbs interface{}) *Protocol {
 
 	dc.Bridges = map[string]*BridgeProto{}
 	protocol := dc.initRootProtocol(cbs)
+	if protocol == nil {
+		return nil
+	}
 
-	dc.restoreBridges()
-	dc.restoreDevices()
+	if dc.SnapshotPath == "" {
+		dc.SnapshotPath = snapshotDir + dc.ProtocolName + ".json"
+	}
+	dc.restore()
 
 	return protocol
 }
 
-func (dc *Dbus) restoreBridges() {
-	// Get the bridges related to this protocol from the DeviceManager
-	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
-	defer cancel()
+// Close stops the background tasks of the protocols and closes the dbus connection
+func (dc *Dbus) Close() {
+	if dc.cancel != nil {
+		dc.cancel()
+	}
+	dc.flushSnapshot()
+	if dc.conn != nil {
+		dc.conn.Close()
+	}
+	dc.Log.Info("Disconnected from DBus")
+}
 
-	var ret json.RawMessage
-	obj := dc.conn.Object(deviceManagerDestination, deviceManagerPath)
-	err := obj.CallWithContext(ctx, deviceManagerBridgesMethod, 0).Store(&ret)
-	if err != nil {
-		dc.Log.Warning("Unable to get the bridges from the DeviceManager: ", err)
-		return
+// context returns the context cancelled when the connection is closed
+func (dc *Dbus) context() context.Context {
+	if dc.ctx == nil {
+		return context.Background()
 	}
-	var bridges BridgeJson
-	err = json.Unmarshal(ret, &bridges)
+	return dc.ctx
+}
+
+// restore creates the bridges, devices and items known by the DeviceManager
+// When the DeviceManager can not be reached, the snapshot is used until it answers
+func (dc *Dbus) restore() {
+	snap := dc.loadSnapshot()
+
+	bridges, protocols, err := dc.fetchDeviceManager()
 	if err != nil {
-		dc.Log.Error("Could not read bridges json from the DeviceManager: ", err)
+		dc.Log.Warning("Unable to restore the devices from the DeviceManager:", err)
+		if snap != nil {
+			dc.applySnapshot(snap)
+		}
+		go dc.retryDeviceManager(deviceManagerRetryInitial, deviceManagerRetryMax)
 		return
 	}
 
-	for bridgeID, bridgeProtocol := range bridges.Bridges {
-		if bridgeProtocol == dc.ProtocolName {
-			dc.RootProtocol.AddBridge(bridgeID)
+	dc.reconcile(bridges, protocols)
+	if snap != nil {
+		dc.restoreValues(snap)
+	}
+}
+
+// retryDeviceManager asks the DeviceManager for the devices with an exponential backoff until it answers
+func (dc *Dbus) retryDeviceManager(delay time.Duration, maxDelay time.Duration) {
+	ctx := dc.context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+
+		bridges, protocols, err := dc.fetchDeviceManager()
+		if err == nil {
+			dc.Log.Info("DeviceManager reachable, reconcile the devices")
+			dc.reconcile(bridges, protocols)
+			return
+		}
+
+		dc.Log.Debug("DeviceManager still unreachable:", err)
+		delay *= 2
+		if delay > maxDelay {
+			delay = maxDelay
 		}
 	}
 }
 
-func (dc *Dbus) restoreDevices() {
-	// Get the devices related to this protocol from the DeviceManager
-	ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
-	defer cancel()
+func (dc *Dbus) fetchDeviceManager() (BridgeJson, ProtocolJson, error) {
+	var bridges BridgeJson
+	var protocols ProtocolJson
 
-	var ret json.RawMessage
-	obj := dc.conn.Object(deviceManagerDestination, deviceManagerPath)
-	err := obj.CallWithContext(ctx, deviceManagerDevicesMethod, 0, dc.ProtocolName).Store(&ret)
+	// Get the bridges related to this protocol from the DeviceManager
+	ret, err := dc.callDeviceManager(deviceManagerBridgesMethod)
 	if err != nil {
-		dc.Log.Warning("Unable to get the devices from the DeviceManager: ", err)
-		return
+		return bridges, protocols, err
+	}
+	if err := json.Unmarshal(ret, &bridges); err != nil {
+		dc.Log.Error("Could not read bridges json from the DeviceManager: ", err)
+		return bridges, protocols, err
 	}
 
-	var protocols ProtocolJson
-	err = json.Unmarshal(ret, &protocols)
+	// Get the devices related to this protocol from the DeviceManager
+	ret, err = dc.callDeviceManager(deviceManagerDevicesMethod, dc.ProtocolName)
 	if err != nil {
+		return bridges, protocols, err
+	}
+	if err := json.Unmarshal(ret, &protocols); err != nil {
 		dc.Log.Error("Could not read devices json from the DeviceManager: ", err)
-		return
+		return bridges, protocols, err
 	}
+	return bridges, protocols, nil
+}
 
+func (dc *Dbus) callDeviceManager(method string, args ...interface{}) (json.RawMessage, error) {
+	ctx, cancel := context.WithTimeout(dc.context(), callTimeout)
+	defer cancel()
+
+	var ret json.RawMessage
+	obj := dc.conn.Object(deviceManagerDestination, deviceManagerPath)
+	err := obj.CallWithContext(ctx, method, 0, args...).Store(&ret)
+	return ret, err
+}
+
+// reconcile makes the bridges, devices and items match the ones known by the DeviceManager
+// The items declared by the driver of a device are kept
+func (dc *Dbus) reconcile(bridges BridgeJson, protocols ProtocolJson) {
+	wanted := map[string]map[string]DeviceJson{"": {}}
+	for bridgeID, bridgeProtocol := range bridges.Bridges {
+		if bridgeProtocol == dc.ProtocolName {
+			wanted[bridgeID] = map[string]DeviceJson{}
+		}
+	}
 	for name, devices := range protocols.Protocols {
-		var protocol *Protocol
-		if name == dc.ProtocolName {
-			// This it root protocol
-			protocol = dc.RootProtocol.Protocol
-		} else {
+		bridgeID := ""
+		if name != dc.ProtocolName {
 			// This is bridge protocol
-			bridgeId := strings.ReplaceAll(name, dc.ProtocolName+"_", "")
-			dc.RootProtocol.AddBridge(bridgeId)
-			protocol = dc.Bridges[bridgeId].Protocol
+			bridgeID = strings.ReplaceAll(name, dc.ProtocolName+"_", "")
+		}
+		if wanted[bridgeID] == nil {
+			wanted[bridgeID] = map[string]DeviceJson{}
 		}
+		for _, dev := range devices {
+			wanted[bridgeID][dev.DevID] = dev
+		}
+	}
+
+	for bridgeID, p := range dc.protocols() {
+		devices, known := wanted[bridgeID]
+		if !known {
+			dc.RootProtocol.RemoveBridge(bridgeID)
+			continue
+		}
+		for _, d := range p.devices() {
+			if _, known := devices[d.DevID]; !known {
+				p.RemoveDevice(d.DevID)
+			}
+		}
+	}
 
+	for bridgeID, devices := range wanted {
+		if bridgeID != "" {
+			dc.RootProtocol.AddBridge(bridgeID)
+		}
+		p := dc.protocols()[bridgeID]
 		for _, dev := range devices {
-			protocol.AddDevice(dev.DevID, dev.ComID, dev.DevTypeID, dev.DevTypeVersion, dev.DevOptions)
-			device := protocol.Devices[dev.DevID]
+			dc.restoreDevice(p, dev, true)
+		}
+	}
+}
 
-			for _, item := range dev.Items {
-				device.AddItem(item.ItemID, item.ItemTypeID, item.ItemTypeVersion, item.ItemOptions)
+// restoreDevice adds the device and its items, or updates their options when they already exist
+// When prune is true, the items which are neither listed nor declared by the device driver are removed
+func (dc *Dbus) restoreDevice(p *Protocol, dev DeviceJson, prune bool) {
+	if _, err := p.AddDevice(dev.DevID, dev.ComID, dev.DevTypeID, dev.DevTypeVersion, dev.DevOptions); err != nil {
+		return
+	}
+	device, ok := p.device(dev.DevID)
+	if !ok {
+		return
+	}
+	device.SetOption(dev.DevOptions)
+
+	listed := make(map[string]bool)
+	for _, item := range dev.Items {
+		listed[item.ItemID] = true
+		if alreadyAdded, _ := device.AddItem(item.ItemID, item.ItemTypeID, item.ItemTypeVersion, item.ItemOptions); alreadyAdded {
+			device.Lock()
+			i := device.Items[item.ItemID]
+			device.Unlock()
+			if i != nil {
+				i.SetOption(item.ItemOptions)
 			}
 		}
 	}
+
+	if !prune {
+		return
+	}
+	if device.Driver != nil {
+		for _, item := range device.Driver.Items {
+			listed[item.ItemID] = true
+		}
+	}
+	device.Lock()
+	var removed []string
+	for itemID := range device.Items {
+		if !listed[itemID] {
+			removed = append(removed, itemID)
+		}
+	}
+	device.Unlock()
+	for _, itemID := range removed {
+		device.RemoveItem(itemID)
+	}
+}
+
+// protocols returns the root protocol with the key "" and the bridge protocols with their bridge ID
+func (dc *Dbus) protocols() map[string]*Protocol {
+	root := dc.RootProtocol.Protocol
+	root.Lock()
+	defer root.Unlock()
+
+	protocols := map[string]*Protocol{"": root}
+	for bridgeID, bridge := range dc.Bridges {
+		protocols[bridgeID] = bridge.Protocol
+	}
+	return protocols
 }
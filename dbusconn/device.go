@@ -8,6 +8,7 @@ import (
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
 	"github.com/op/go-logging"
+	"github.com/opencaps/pif/driver"
 )
 
 const (
@@ -59,16 +60,36 @@ type Device struct {
 
 	Items map[string]*Item
 
+	// Driver of the device type, nil when no device driver is known
+	Driver *driver.DeviceDriver
+
 	dc         *Dbus
 	timer      *time.Timer
+	lastSeen   time.Time
 	properties *prop.Properties
 	log        *logging.Logger
+	queue      *commandQueue
+
+	pairingTimer *time.Timer
+	firmwareJob  *FirmwareJob
+	// publishMu keeps the properties in the order the fields were set
+	publishMu sync.Mutex
+	// lost is true when the device went KO because it was not heard from
+	lost bool
 
 	addItemCB            interface{ AddItem(*Item) }
 	removeItemCB         interface{ RemoveItem(string, string) }
 	setDeviceOptionCb    interface{ SetDeviceOptions(*Device) }
-	updateFirmwareCb     interface{ UpdateFirmware(*Device, string) }
+	updateFirmwareCb     interface{ UpdateFirmware(*FirmwareJob) }
 	operabilityTimeoutCB interface{ OperabilityWentKo(*Device) }
+	sendCB               Sender
+	startPairingCB       interface{ StartPairing(*Device, time.Duration) }
+	cancelPairingCB      interface{ CancelPairing(*Device) }
+	unpairCB             interface{ Unpair(*Device) }
+
+	changeDeviceOptionsCB DeviceOptionsChanger
+	// legacyUpdateFirmware callback of the protocol apps written before the firmware jobs
+	legacyUpdateFirmware func(*Device, string) error
 }
 
 // OperabilityState informs if the device work
@@ -77,7 +98,7 @@ type OperabilityState string
 // PairingState informs the state of the pairing
 type PairingState string
 
-func initDevice(devID string, address string, typeID string, typeVersion string, options []byte, p *Protocol) {
+func initDevice(devID string, address string, typeID string, typeVersion string, options []byte, p *Protocol) *Device {
 	d := &Device{
 		DevID:        devID,
 		Address:      address,
@@ -102,11 +123,39 @@ func initDevice(devID string, address string, typeID string, typeVersion string,
 
 	//Emit Device Added
 	d.EmitDbusSignal(signalDeviceAdded, d.Address, d.TypeID, d.TypeVersion, d.Options)
+	d.dc.snapshotChanged()
+	return d
+}
+
+// applyDeviceDriver resolves the driver of the device type and creates the items it declares
+// The protocol lock must not be held, the protocol app is called for each item
+func (d *Device) applyDeviceDriver() {
+	if d.dc.Drivers == nil {
+		return
+	}
+
+	dd, ok := d.dc.Drivers.GetDeviceDriver(d.TypeID, d.TypeVersion)
+	if !ok {
+		return
+	}
+	d.Driver = dd
+
+	if d.OperabilityTimeout == 0 {
+		d.OperabilityTimeout = dd.OperabilityTimeout
+	}
+
+	for _, item := range dd.Items {
+		d.AddItem(item.ItemID, item.ItemTypeID, item.ItemTypeVersion, item.ItemOptions)
+	}
 }
 
 func removeDevice(d *Device) {
 	p := d.Protocol
 	path := dbus.ObjectPath(dbusPathPrefix + p.protocolName + "/" + d.DevID)
+	d.stopQueue()
+	d.stopWatchdog()
+	d.stopPairingTimer()
+	d.cancelFirmwareUpdate()
 	d.Lock()
 	for _, i := range d.Items {
 		removeItem(i)
@@ -118,37 +167,108 @@ func removeDevice(d *Device) {
 	delete(p.Devices, d.DevID)
 	p.dc.conn.Emit(path, dbusDeviceInterface+"."+signalDeviceRemoved)
 	p.dc.conn.Export(nil, path, dbusDeviceInterface)
+	p.dc.snapshotChanged()
 }
 
 func (d *Device) operabilityCBTimeout() {
-	d.SetOperabilityState(OperabilityKo)
+	d.log.Warning("No value from the device", d.DevID, "before its operability timeout")
+	d.setLost()
 
 	if !isNil(d.operabilityTimeoutCB) {
 		go d.operabilityTimeoutCB.OperabilityWentKo(d)
 	}
 }
 
-func (d *Device) setDeviceOptions(c *prop.Change) *dbus.Error {
+// setOptions is the dbus write of the property Options, it is decided before the properties are locked
+func (d *Device) setOptions(options []byte) *dbus.Error {
+	return d.changeOptions(options, false)
+}
+
+// MergeOptions is the dbus method to update a part of the options with a JSON merge patch (RFC 7386)
+func (d *Device) MergeOptions(patch []byte) *dbus.Error {
+	d.log.Info("MergeOptions called - devID:", d.DevID, "patch:", string(patch))
+	return d.changeOptions(patch, true)
+}
+
+// changeOptions validates the new options, lets the protocol app veto them, then stores and publishes them
+// When merge is true, change is a JSON merge patch applied to the current options
+// No lock is held during the veto, the change is decided again if the options changed meanwhile
+func (d *Device) changeOptions(change []byte, merge bool) *dbus.Error {
+	var oldOptions, options []byte
+	for stored := false; !stored; {
+		oldOptions = d.GetOptions()
+		options = change
+		if merge {
+			merged, err := mergePatch(oldOptions, change)
+			if err != nil {
+				d.log.Warning("Options patch of the device", d.DevID, "not valid:", err)
+				return dbus.NewError(errInvalidArgs, []interface{}{err.Error()})
+			}
+			options = merged
+		}
+
+		if err := d.dc.validateDeviceOptions(d.TypeID, d.TypeVersion, options); err != nil {
+			d.log.Warning("Options of the device", d.DevID, "refused:", err.Error())
+			return err
+		}
+		if !isNil(d.changeDeviceOptionsCB) {
+			if err := d.changeDeviceOptionsCB.ChangeDeviceOptions(d, oldOptions, options); err != nil {
+				d.log.Warning("Options of the device", d.DevID, "vetoed:", err)
+				return dbus.NewError(errInvalidArgs, []interface{}{err.Error()})
+			}
+		}
+
+		d.Lock()
+		stored = bytes.Equal(d.Options, oldOptions)
+		if stored {
+			d.Options = options
+		}
+		d.Unlock()
+	}
+	d.log.Info("propertyOptions of the device", d.DevID, "changed from", string(oldOptions), "to", string(options))
+	d.dc.snapshotChanged()
+	d.publishOptions()
+
 	if !isNil(d.setDeviceOptionCb) {
 		go d.setDeviceOptionCb.SetDeviceOptions(d)
-	} else {
-		d.log.Warning("No Options")
 	}
 	return nil
 }
 
+// publishOptions sets the property Options to the stored options
+func (d *Device) publishOptions() {
+	if d.properties == nil {
+		return
+	}
+	d.publishMu.Lock()
+	d.properties.SetMust(dbusDeviceInterface, propertyOptions, d.GetOptions())
+	d.publishMu.Unlock()
+}
+
 // AddItem adds a new item to device
 func (d *Device) AddItem(itemID string, typeID string, typeVersion string, options []byte) (bool, *dbus.Error) {
 	d.log.Info("AddItem called - itemID:", itemID, "typeID:", typeID, "typeVersion:", typeVersion, "options:", options)
+	if err := d.dc.validateItemOptions(typeID, typeVersion, options); err != nil {
+		d.log.Warning("Item", itemID, "refused:", err.Error())
+		return false, err
+	}
 	d.Lock()
 	_, itemPresent := d.Items[itemID]
-	if !itemPresent {
-		initItem(itemID, typeID, typeVersion, options, d)
+	d.Unlock()
+	if itemPresent {
+		return true, nil
+	}
+
+	i := newItem(itemID, typeID, typeVersion, options, d)
+	d.Lock()
+	if _, itemPresent = d.Items[itemID]; itemPresent {
 		d.Unlock()
-		return false, nil
+		return true, nil
 	}
+	initItem(i)
 	d.Unlock()
-	return true, nil
+	d.updatePairingNeeded()
+	return false, nil
 }
 
 // RemoveItem remove item from device
@@ -160,16 +280,11 @@ func (d *Device) RemoveItem(itemID string) *dbus.Error {
 		removeItem(i)
 	}
 	d.Unlock()
-	return nil
-}
-
-// UpdateFirmware is the dbus method to update the firmware of the device
-func (d *Device) UpdateFirmware(data string) (string, *dbus.Error) {
-	if !isNil(d.updateFirmwareCb) {
-		go d.updateFirmwareCb.UpdateFirmware(d, data)
+	if present {
+		d.updatePairingNeeded()
+		d.updateOperability()
 	}
-	d.log.Warning("Update firmware not implemented")
-	return "", nil
+	return nil
 }
 
 // EmitDbusSignal emit a dbus signal from device object
@@ -184,27 +299,32 @@ func (d *Device) SetOperabilityState(state OperabilityState) {
 		return
 	}
 
-	if d.OperabilityTimeout != 0 && state == OperabilityOk {
-		if d.timer == nil {
-			d.timer = time.AfterFunc(d.OperabilityTimeout, d.operabilityCBTimeout)
-		} else {
-			d.timer.Reset(d.OperabilityTimeout)
-		}
-	}
-
-	oldVariant, err := d.properties.Get(dbusDeviceInterface, propertyOperabilityState)
-
-	if err != nil {
-		return
+	d.publishMu.Lock()
+	d.Lock()
+	if state == OperabilityOk {
+		d.armWatchdog()
 	}
 
-	oldState := oldVariant.Value().(OperabilityState)
+	oldState := d.Operability
 	if oldState == state {
+		d.Unlock()
+		d.publishMu.Unlock()
 		return
 	}
+	d.Operability = state
+	d.Unlock()
 
 	d.log.Info("OperabilityState of the device", d.DevID, "changed from", oldState, "to", state)
 	d.properties.SetMust(dbusDeviceInterface, propertyOperabilityState, state)
+	d.publishMu.Unlock()
+	d.Protocol.updateReachability()
+}
+
+// GetOperability returns the value of the property OperabilityState
+func (d *Device) GetOperability() OperabilityState {
+	d.Lock()
+	defer d.Unlock()
+	return d.Operability
 }
 
 // SetPairingState set the value of the property PairingState
@@ -213,55 +333,85 @@ func (d *Device) SetPairingState(state PairingState) {
 		return
 	}
 
-	oldVariant, err := d.properties.Get(dbusDeviceInterface, propertyPairingState)
-
-	if err != nil {
-		return
+	if state != PairingInProgress {
+		d.stopPairingTimer()
 	}
 
-	oldState := oldVariant.Value().(PairingState)
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+	d.Lock()
+	oldState := d.PairingState
 	if oldState == state {
+		d.Unlock()
 		return
 	}
+	d.PairingState = state
+	d.Unlock()
 
 	d.log.Info("propertyPairingState of the device", d.DevID, "changed from", oldState, "to", state)
 	d.properties.SetMust(dbusDeviceInterface, propertyPairingState, state)
 }
 
+// GetPairingState returns the value of the property PairingState
+func (d *Device) GetPairingState() PairingState {
+	d.Lock()
+	defer d.Unlock()
+	return d.PairingState
+}
+
 // SetVersion set the value of the property Version
 func (d *Device) SetVersion(newVersion string) {
 	if d.properties == nil {
 		return
 	}
 
-	if d.FirmwareVersion == newVersion {
+	d.publishMu.Lock()
+	defer d.publishMu.Unlock()
+	d.Lock()
+	oldVersion := d.FirmwareVersion
+	if oldVersion == newVersion {
+		d.Unlock()
 		return
 	}
+	d.FirmwareVersion = newVersion
+	d.Unlock()
 
-	d.log.Info("Version of the device", d.DevID, "changed from", d.FirmwareVersion, "to", newVersion)
+	d.log.Info("Version of the device", d.DevID, "changed from", oldVersion, "to", newVersion)
 	d.properties.SetMust(dbusDeviceInterface, propertyVersion, newVersion)
 }
 
+// GetFirmwareVersion returns the value of the property Version
+func (d *Device) GetFirmwareVersion() string {
+	d.Lock()
+	defer d.Unlock()
+	return d.FirmwareVersion
+}
+
 // SetOption set the value of the property Option
 func (d *Device) SetOption(options []byte) {
 	if d.properties == nil {
 		return
 	}
 
-	oldVariant, err := d.properties.Get(dbusDeviceInterface, propertyOptions)
-
-	if err != nil {
+	d.Lock()
+	oldState := d.Options
+	if bytes.Equal(oldState, options) {
+		d.Unlock()
 		return
 	}
+	d.Options = options
+	d.Unlock()
 
-	oldState := oldVariant.Value().([]byte)
-	newState := []byte(options)
-	if bytes.Equal(oldState, newState) {
-		return
-	}
+	d.log.Info("propertyOptions of the device", d.DevID, "changed from", string(oldState), "to", string(options))
+	d.dc.snapshotChanged()
+	d.publishOptions()
+}
 
-	d.log.Info("propertyOptions of the device", d.DevID, "changed from", string(oldState), "to", string(newState))
-	d.properties.SetMust(dbusDeviceInterface, propertyOptions, newState)
+// GetOptions returns the value of the property Options
+func (d *Device) GetOptions() []byte {
+	d.Lock()
+	defer d.Unlock()
+	return d.Options
 }
 
 // SetCallbacks set new callbacks for this device
@@ -279,13 +429,42 @@ func (d *Device) SetCallbacks(cbs interface{}) {
 		d.setDeviceOptionCb = cb
 	}
 	switch cb := cbs.(type) {
-	case interface{ UpdateFirmware(*Device, string) }:
+	case DeviceOptionsChanger:
+		d.changeDeviceOptionsCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface{ UpdateFirmware(*FirmwareJob) }:
 		d.updateFirmwareCb = cb
 	}
 	switch cb := cbs.(type) {
+	case interface{ UpdateFirmware(*Device, string) error }:
+		d.legacyUpdateFirmware = cb.UpdateFirmware
+	case interface{ UpdateFirmware(*Device, string) }:
+		d.legacyUpdateFirmware = func(d *Device, uri string) error {
+			cb.UpdateFirmware(d, uri)
+			return nil
+		}
+	}
+	switch cb := cbs.(type) {
 	case interface{ OperabilityWentKo(*Device) }:
 		d.operabilityTimeoutCB = cb
 	}
+	switch cb := cbs.(type) {
+	case Sender:
+		d.sendCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface{ StartPairing(*Device, time.Duration) }:
+		d.startPairingCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface{ CancelPairing(*Device) }:
+		d.cancelPairingCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface{ Unpair(*Device) }:
+		d.unpairCB = cb
+	}
 }
 
 // SetDbusMethods set new dbusMethods for this device
@@ -294,6 +473,12 @@ func (d *Device) SetDbusMethods(externalMethods map[string]interface{}) bool {
 	exportedMethods := make(map[string]interface{})
 	exportedMethods["AddItem"] = d.AddItem
 	exportedMethods["RemoveItem"] = d.RemoveItem
+	exportedMethods["MergeOptions"] = d.MergeOptions
+	exportedMethods["StartPairing"] = d.StartPairing
+	exportedMethods["CancelPairing"] = d.CancelPairing
+	exportedMethods["Unpair"] = d.Unpair
+	exportedMethods["UpdateFirmware"] = d.UpdateFirmware
+	exportedMethods["CancelFirmwareUpdate"] = d.CancelFirmwareUpdate
 
 	for name, inter := range externalMethods {
 		exportedMethods[name] = inter
@@ -330,11 +515,29 @@ func (d *Device) SetDbusProperties(externalProperties map[string]*prop.Prop) boo
 				Emit:     prop.EmitTrue,
 				Callback: nil,
 			},
+			propertyLastSeen: {
+				Value:    int64(0),
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyFirmwareUpdateState: {
+				Value:    FirmwareIdle,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyFirmwareUpdateProgress: {
+				Value:    uint32(0),
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
 			propertyOptions: {
 				Value:    d.Options,
 				Writable: true,
 				Emit:     prop.EmitTrue,
-				Callback: d.setDeviceOptions,
+				Callback: nil,
 			},
 		},
 	}
@@ -343,7 +546,7 @@ func (d *Device) SetDbusProperties(externalProperties map[string]*prop.Prop) boo
 		propsSpec[dbusDeviceInterface][pName] = p
 	}
 
-	properties, err := prop.Export(d.dc.conn, path, propsSpec)
+	properties, err := d.dc.exportProperties(path, propsSpec, dbusDeviceInterface, d.setOptions)
 	if err == nil {
 		d.properties = properties
 	} else {
@@ -0,0 +1,253 @@
+package dbusconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/op/go-logging"
+)
+
+// startTestBus starts a private bus and returns its address
+// The test is skipped when dbus-daemon is not installed
+func startTestBus(t *testing.T) string {
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon not found")
+	}
+
+	address := "unix:path=" + filepath.Join(t.TempDir(), "bus")
+	cmd := exec.Command(daemon, "--session", "--nofork", "--nopidfile", "--address="+address)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	return address
+}
+
+func connectTestBus(t *testing.T, address string) *dbus.Conn {
+	for start := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, err := dbus.Connect(address)
+		if err == nil {
+			return conn
+		}
+		if time.Since(start) > 5*time.Second {
+			t.Fatal("Unable to connect to the test bus:", err)
+		}
+	}
+}
+
+// newTestDbus exports the root protocol on the bus, the snapshot is disabled when snapshotPath is empty
+func newTestDbus(t *testing.T, address string, snapshotPath string) *Dbus {
+	logging.SetLevel(logging.ERROR, "dbus-test")
+	dc := &Dbus{
+		conn:            connectTestBus(t, address),
+		ProtocolName:    "test",
+		Bridges:         map[string]*BridgeProto{},
+		Log:             logging.MustGetLogger("dbus-test"),
+		SnapshotPath:    snapshotPath,
+		DisableSnapshot: snapshotPath == "",
+	}
+	dc.ctx, dc.cancel = context.WithCancel(context.Background())
+	t.Cleanup(dc.Close)
+
+	if dc.initRootProtocol(nil) == nil {
+		t.Fatal("Protocol not exported")
+	}
+	return dc
+}
+
+// newTestDevice exports a protocol with one device and one item on a private bus
+func newTestDevice(t *testing.T) (*Device, *Item) {
+	p := newTestDbus(t, startTestBus(t), "").RootProtocol.Protocol
+	if _, err := p.AddDevice("dev", "com", "devType", "1.0.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	d, ok := p.device("dev")
+	if !ok {
+		t.Fatal("Device not added")
+	}
+	if _, err := d.AddItem("item", "itemType", "1.0.0", nil); err != nil {
+		t.Fatal(err)
+	}
+	d.Lock()
+	i := d.Items["item"]
+	d.Unlock()
+	if i == nil {
+		t.Fatal("Item not added")
+	}
+	return d, i
+}
+
+func checkProperty(t *testing.T, props *prop.Properties, iface string, name string, want interface{}) {
+	t.Helper()
+	if got := props.GetMust(iface, name); !reflect.DeepEqual(got, want) {
+		t.Errorf("Property %s is %v (%T), the field is %v (%T)", name, got, got, want, want)
+	}
+}
+
+func checkDevice(t *testing.T, d *Device) {
+	t.Helper()
+	checkProperty(t, d.properties, dbusDeviceInterface, propertyVersion, d.GetFirmwareVersion())
+	checkProperty(t, d.properties, dbusDeviceInterface, propertyOperabilityState, d.GetOperability())
+	checkProperty(t, d.properties, dbusDeviceInterface, propertyPairingState, d.GetPairingState())
+	checkProperty(t, d.properties, dbusDeviceInterface, propertyOptions, d.GetOptions())
+}
+
+func checkItem(t *testing.T, i *Item) {
+	t.Helper()
+	checkProperty(t, i.properties, dbusItemInterface, propertyOperabilityState, i.GetOperability())
+	checkProperty(t, i.properties, dbusItemInterface, propertyOptions, i.GetOptions())
+	checkProperty(t, i.properties, dbusItemInterface, propertyValue, i.GetValue())
+}
+
+func TestDeviceSetters(t *testing.T) {
+	d, _ := newTestDevice(t)
+
+	d.SetVersion("1.2.0")
+	d.SetOperabilityState(OperabilityKo)
+	d.SetPairingState(PairingOk)
+	d.SetOption([]byte(`{"channel":11}`))
+
+	if got := d.GetFirmwareVersion(); got != "1.2.0" {
+		t.Errorf("GetFirmwareVersion returned %q", got)
+	}
+	if got := d.GetOperability(); got != OperabilityKo {
+		t.Errorf("GetOperability returned %q", got)
+	}
+	if got := d.GetPairingState(); got != PairingOk {
+		t.Errorf("GetPairingState returned %q", got)
+	}
+	if got := string(d.GetOptions()); got != `{"channel":11}` {
+		t.Errorf("GetOptions returned %s", got)
+	}
+	checkDevice(t, d)
+}
+
+func TestItemSetters(t *testing.T) {
+	_, i := newTestDevice(t)
+
+	i.SetOperabilityState(OperabilityPartial)
+	i.SetOption([]byte(`{"unit":"C"}`))
+	i.SetValue([]byte("21.5"))
+
+	if got := i.GetOperability(); got != OperabilityPartial {
+		t.Errorf("GetOperability returned %q", got)
+	}
+	if got := string(i.GetOptions()); got != `{"unit":"C"}` {
+		t.Errorf("GetOptions returned %s", got)
+	}
+	if got := string(i.GetValue()); got != "21.5" {
+		t.Errorf("GetValue returned %s", got)
+	}
+	checkItem(t, i)
+}
+
+// TestConcurrentSetters is meant to be run with -race
+func TestConcurrentSetters(t *testing.T) {
+	d, i := newTestDevice(t)
+
+	operability := []OperabilityState{OperabilityOk, OperabilityKo, OperabilityPartial}
+	pairing := []PairingState{PairingOk, PairingKo, PairingNotNeeded}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(2)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				d.SetVersion(fmt.Sprintf("%d.%d.0", w, n))
+				d.SetOperabilityState(operability[(w+n)%len(operability)])
+				d.SetPairingState(pairing[(w+n)%len(pairing)])
+				d.SetOption([]byte(fmt.Sprintf(`{"w":%d,"n":%d}`, w, n)))
+				i.SetOperabilityState(operability[(w+n)%len(operability)])
+				i.SetOption([]byte(fmt.Sprintf(`{"n":%d}`, n)))
+				i.SetValue([]byte(fmt.Sprint(w*100 + n)))
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for n := 0; n < 50; n++ {
+				d.GetFirmwareVersion()
+				d.GetOperability()
+				d.GetPairingState()
+				d.GetOptions()
+				i.GetOperability()
+				i.GetOptions()
+				i.GetValue()
+				i.GetTarget()
+			}
+		}()
+	}
+	wg.Wait()
+
+	checkDevice(t, d)
+	checkItem(t, i)
+}
+
+// reentrantVeto calls the device and the item from the options veto
+type reentrantVeto struct{}
+
+func (reentrantVeto) ChangeDeviceOptions(d *Device, oldOptions []byte, newOptions []byte) error {
+	d.SetPairingState(PairingOk)
+	d.GetOptions()
+	return nil
+}
+
+func (reentrantVeto) ChangeItemOptions(i *Item, oldOptions []byte, newOptions []byte) error {
+	i.SetValue([]byte("1"))
+	i.SetOperabilityState(OperabilityOk)
+	if string(newOptions) == `{"refused":true}` {
+		return errors.New("refused")
+	}
+	return nil
+}
+
+func TestOptionsVetoReentrant(t *testing.T) {
+	d, i := newTestDevice(t)
+	d.SetCallbacks(&reentrantVeto{})
+	i.SetCallbacks(&reentrantVeto{})
+
+	conn := d.dc.conn
+	devicePath := dbus.ObjectPath(dbusPathPrefix + d.Protocol.protocolName + "/" + d.DevID)
+	device := conn.Object(conn.Names()[0], devicePath)
+	item := conn.Object(conn.Names()[0], devicePath+"/"+dbus.ObjectPath(i.ItemID))
+	call := func(obj dbus.BusObject, method string, args ...interface{}) error {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		return obj.CallWithContext(ctx, method, 0, args...).Err
+	}
+
+	if err := call(device, "org.freedesktop.DBus.Properties.Set", dbusDeviceInterface, propertyOptions, dbus.MakeVariant([]byte(`{"a":1}`))); err != nil {
+		t.Fatal("Device options write failed:", err)
+	}
+	if err := call(item, "org.freedesktop.DBus.Properties.Set", dbusItemInterface, propertyOptions, dbus.MakeVariant([]byte(`{"b":2}`))); err != nil {
+		t.Fatal("Item options write failed:", err)
+	}
+	if err := call(item, dbusItemInterface+".MergeOptions", []byte(`{"c":3}`)); err != nil {
+		t.Fatal("Item options merge failed:", err)
+	}
+	if err := call(item, "org.freedesktop.DBus.Properties.Set", dbusItemInterface, propertyOptions, dbus.MakeVariant([]byte(`{"refused":true}`))); err == nil {
+		t.Error("Vetoed options accepted")
+	}
+
+	if got := string(d.GetOptions()); got != `{"a":1}` {
+		t.Errorf("Device options are %s", got)
+	}
+	if got := string(i.GetOptions()); got != `{"b":2,"c":3}` {
+		t.Errorf("Item options are %s", got)
+	}
+	checkDevice(t, d)
+	checkItem(t, i)
+}
@@ -0,0 +1,185 @@
+package dbusconn
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	propertyFirmwareUpdateState    = "FirmwareUpdateState"
+	propertyFirmwareUpdateProgress = "FirmwareUpdateProgress"
+
+	signalFirmwareUpdateFinished = "FirmwareUpdateFinished"
+
+	// FirmwareIdle state 'idle' for FirmwareUpdateState, no update has been started
+	FirmwareIdle FirmwareUpdateState = "IDLE"
+	// FirmwareRunning state 'running' for FirmwareUpdateState
+	FirmwareRunning FirmwareUpdateState = "RUNNING"
+	// FirmwareSucceeded state 'succeeded' for FirmwareUpdateState
+	FirmwareSucceeded FirmwareUpdateState = "SUCCEEDED"
+	// FirmwareFailed state 'failed' for FirmwareUpdateState
+	FirmwareFailed FirmwareUpdateState = "FAILED"
+	// FirmwareCancelled state 'cancelled' for FirmwareUpdateState
+	FirmwareCancelled FirmwareUpdateState = "CANCELLED"
+	// FirmwareUnverified state 'unverified' for FirmwareUpdateState, the protocol app does not report the result
+	FirmwareUnverified FirmwareUpdateState = "UNVERIFIED"
+)
+
+// FirmwareUpdateState informs about the last firmware update of the device
+type FirmwareUpdateState string
+
+// FirmwareJob is the handle given to the protocol app to report a firmware update
+type FirmwareJob struct {
+	ID     string
+	URI    string
+	Method string
+	Device *Device
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var firmwareJobCounter uint64
+
+var (
+	errFirmwareNotSupported = dbus.NewError("org.freedesktop.DBus.Error.NotSupported", []interface{}{"firmware update not supported"})
+	errFirmwareRunning      = dbus.MakeFailedError(errors.New("a firmware update is already running"))
+)
+
+// UpdateFirmware is the dbus method to update the firmware of the device from uri
+// It returns the ID of the update job
+func (d *Device) UpdateFirmware(uri string) (string, *dbus.Error) {
+	d.log.Info("UpdateFirmware called - devID:", d.DevID, "uri:", uri)
+	if isNil(d.updateFirmwareCb) && d.legacyUpdateFirmware == nil {
+		return "", errFirmwareNotSupported
+	}
+
+	ctx, cancel := context.WithCancel(d.dc.context())
+	job := &FirmwareJob{
+		ID:     fmt.Sprintf("%s-%d", d.DevID, atomic.AddUint64(&firmwareJobCounter, 1)),
+		URI:    uri,
+		Device: d,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	if d.Driver != nil {
+		job.Method = d.Driver.FirmwareUpdateMethod
+	}
+
+	d.Lock()
+	if d.firmwareJob != nil {
+		d.Unlock()
+		cancel()
+		return "", errFirmwareRunning
+	}
+	d.firmwareJob = job
+	d.Unlock()
+
+	d.setFirmwareProperties(FirmwareRunning, 0)
+	if !isNil(d.updateFirmwareCb) {
+		go d.updateFirmwareCb.UpdateFirmware(job)
+	} else {
+		// The legacy callback does not report the result, the update is only known to be started
+		go func() {
+			if err := d.legacyUpdateFirmware(d, uri); err != nil {
+				job.Fail(err.Error())
+			} else {
+				job.finish(FirmwareUnverified, "result not reported by the protocol app")
+			}
+		}()
+	}
+	return job.ID, nil
+}
+
+// CancelFirmwareUpdate is the dbus method to cancel the firmware update jobID
+func (d *Device) CancelFirmwareUpdate(jobID string) *dbus.Error {
+	d.log.Info("CancelFirmwareUpdate called - devID:", d.DevID, "jobID:", jobID)
+	d.Lock()
+	job := d.firmwareJob
+	d.Unlock()
+
+	if job == nil || job.ID != jobID {
+		return &dbus.ErrMsgInvalidArg
+	}
+	job.finish(FirmwareCancelled, "cancelled")
+	return nil
+}
+
+// Context returns a context cancelled when the job is cancelled or finished
+func (j *FirmwareJob) Context() context.Context {
+	return j.ctx
+}
+
+// Progress reports the progress of the update, in percent
+func (j *FirmwareJob) Progress(percent uint32) {
+	if percent > 100 {
+		percent = 100
+	}
+	d := j.Device
+	d.Lock()
+	running := d.firmwareJob == j
+	d.Unlock()
+
+	if running {
+		d.setFirmwareProperties(FirmwareRunning, percent)
+	}
+}
+
+// Succeed ends the update, version is the new firmware version of the device
+func (j *FirmwareJob) Succeed(version string) {
+	if j.finish(FirmwareSucceeded, version) && version != "" {
+		j.Device.SetVersion(version)
+	}
+}
+
+// Fail ends the update because of reason
+func (j *FirmwareJob) Fail(reason string) {
+	j.finish(FirmwareFailed, reason)
+}
+
+// finish ends the job if it is still running, message is the new version or the failure reason
+func (j *FirmwareJob) finish(state FirmwareUpdateState, message string) bool {
+	d := j.Device
+	d.Lock()
+	if d.firmwareJob != j {
+		d.Unlock()
+		return false
+	}
+	d.firmwareJob = nil
+	d.Unlock()
+	j.cancel()
+
+	progress := uint32(0)
+	if state == FirmwareSucceeded {
+		progress = 100
+	} else if d.properties != nil {
+		progress, _ = d.properties.GetMust(dbusDeviceInterface, propertyFirmwareUpdateProgress).(uint32)
+	}
+
+	d.log.Info("Firmware update", j.ID, "of the device", d.DevID, "ended with", state, message)
+	d.setFirmwareProperties(state, progress)
+	d.EmitDbusSignal(signalFirmwareUpdateFinished, j.ID, string(state), message)
+	return true
+}
+
+func (d *Device) setFirmwareProperties(state FirmwareUpdateState, progress uint32) {
+	if d.properties == nil {
+		return
+	}
+	d.properties.SetMust(dbusDeviceInterface, propertyFirmwareUpdateState, state)
+	d.properties.SetMust(dbusDeviceInterface, propertyFirmwareUpdateProgress, progress)
+}
+
+func (d *Device) cancelFirmwareUpdate() {
+	d.Lock()
+	job := d.firmwareJob
+	d.Unlock()
+
+	if job != nil {
+		job.finish(FirmwareCancelled, "device removed")
+	}
+}
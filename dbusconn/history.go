@@ -0,0 +1,92 @@
+package dbusconn
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	defaultHistorySize = 32
+)
+
+// HistoryEntry is a value published by an item
+type HistoryEntry struct {
+	Timestamp time.Time
+	Value     []byte
+	Quality   Quality
+
+	dbusValue interface{}
+}
+
+// historyRecord is the dbus representation of an HistoryEntry (timestamp in ms, value)
+type historyRecord struct {
+	Timestamp int64
+	Value     dbus.Variant
+}
+
+// addHistory appends an entry in the ring buffer of the item, the oldest entry is overwritten when full
+func (i *Item) addHistory(entry HistoryEntry) {
+	size := i.Device.Protocol.HistorySize
+	if size <= 0 {
+		return
+	}
+
+	i.Lock()
+	if len(i.history) != size {
+		// First entry or size changed, keep the most recent entries
+		old := i.historyLocked(time.Time{}, size)
+		i.history = make([]HistoryEntry, size)
+		i.historyLen = copy(i.history, old)
+		i.historyNext = i.historyLen % size
+	}
+	i.history[i.historyNext] = entry
+	i.historyNext = (i.historyNext + 1) % size
+	if i.historyLen < size {
+		i.historyLen++
+	}
+	i.Unlock()
+}
+
+// History returns the values published after since, from the oldest to the newest
+// When limit is positive, only the limit most recent values are returned
+func (i *Item) History(since time.Time, limit int) []HistoryEntry {
+	i.Lock()
+	defer i.Unlock()
+	return i.historyLocked(since, limit)
+}
+
+func (i *Item) historyLocked(since time.Time, limit int) []HistoryEntry {
+	entries := make([]HistoryEntry, 0, i.historyLen)
+	start := i.historyNext - i.historyLen
+	if start < 0 {
+		start += len(i.history)
+	}
+	for n := 0; n < i.historyLen; n++ {
+		entry := i.history[(start+n)%len(i.history)]
+		if entry.Timestamp.After(since) {
+			entries = append(entries, entry)
+		}
+	}
+
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries
+}
+
+// GetHistory is the dbus method to get the values published after since (unix time in ms)
+// When limit is not 0, only the limit most recent values are returned
+func (i *Item) GetHistory(since int64, limit uint32) ([]historyRecord, *dbus.Error) {
+	sinceTime := time.Unix(0, since*int64(time.Millisecond))
+	entries := i.History(sinceTime, int(limit))
+
+	records := make([]historyRecord, len(entries))
+	for idx, entry := range entries {
+		records[idx] = historyRecord{
+			Timestamp: entry.Timestamp.UnixNano() / int64(time.Millisecond),
+			Value:     dbus.MakeVariant(entry.dbusValue),
+		}
+	}
+	return records, nil
+}
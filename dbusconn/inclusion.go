@@ -0,0 +1,90 @@
+package dbusconn
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	propertyInclusionActive = "InclusionActive"
+
+	signalDeviceDiscovered = "DeviceDiscovered"
+
+	defaultInclusionDuration = 60 * time.Second
+)
+
+// StartInclusion is the dbus method to let the protocol discover new devices during durationSec, 0 means the default duration
+func (p *Protocol) StartInclusion(durationSec uint32) *dbus.Error {
+	p.log.Info("StartInclusion called - protocol:", p.protocolName, "duration:", durationSec)
+	duration := time.Duration(durationSec) * time.Second
+	if duration == 0 {
+		duration = defaultInclusionDuration
+	}
+
+	p.Lock()
+	if p.inclusionTimer != nil {
+		p.inclusionTimer.Stop()
+	}
+	p.inclusionTimer = time.AfterFunc(duration, func() {
+		p.log.Info("Inclusion of the protocol", p.protocolName, "timed out")
+		p.StopInclusion()
+	})
+	wasActive := p.inclusionActive
+	p.inclusionActive = true
+	p.Unlock()
+
+	if !wasActive && p.properties != nil {
+		p.properties.SetMust(dbusProtocolInterface, propertyInclusionActive, true)
+	}
+	if !isNil(p.startInclusionCB) {
+		go p.startInclusionCB.StartInclusion(p, duration)
+	}
+	return nil
+}
+
+// StopInclusion is the dbus method to stop the discovery of new devices
+func (p *Protocol) StopInclusion() *dbus.Error {
+	p.Lock()
+	if p.inclusionTimer != nil {
+		p.inclusionTimer.Stop()
+		p.inclusionTimer = nil
+	}
+	wasActive := p.inclusionActive
+	p.inclusionActive = false
+	p.Unlock()
+
+	if !wasActive {
+		return nil
+	}
+
+	p.log.Info("Inclusion of the protocol", p.protocolName, "stopped")
+	if p.properties != nil {
+		p.properties.SetMust(dbusProtocolInterface, propertyInclusionActive, false)
+	}
+	if !isNil(p.stopInclusionCB) {
+		go p.stopInclusionCB.StopInclusion(p)
+	}
+	return nil
+}
+
+// InclusionActive returns true while the protocol discovers new devices
+func (p *Protocol) InclusionActive() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.inclusionActive
+}
+
+// AnnounceDiscovered emits the DeviceDiscovered signal for a device heard by the protocol app
+// The DeviceManager may then accept the device with AddDevice
+// Nothing is emitted and false is returned when the inclusion is not active
+func (p *Protocol) AnnounceDiscovered(comID string, typeID string, typeVersion string, info []byte) bool {
+	if !p.InclusionActive() {
+		p.log.Info("Device", comID, "discovered while inclusion not active, ignored")
+		return false
+	}
+
+	p.log.Info("Device discovered - comID:", comID, "typeID:", typeID, "typeVersion:", typeVersion)
+	p.EmitDbusSignal(signalDeviceDiscovered, comID, typeID, typeVersion, info)
+	return true
+}
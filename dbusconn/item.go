@@ -2,10 +2,16 @@ package dbusconn
 
 import (
 	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
 	"github.com/op/go-logging"
+	"github.com/opencaps/pif/driver"
 )
 
 const (
@@ -18,6 +24,8 @@ const (
 
 // Item object structure
 type Item struct {
+	sync.Mutex
+
 	Device *Device
 
 	ItemID      string
@@ -27,28 +35,90 @@ type Item struct {
 	Options     []byte
 	Target      []byte
 	Value       []byte
-
-	dc         *Dbus
-	properties *prop.Properties
-	log        *logging.Logger
+	Operability OperabilityState
+
+	// ValueKind tells how Value and Target are exported, ValueBytes keeps the legacy byte arrays
+	ValueKind ValueKind
+	// EnumValues values allowed for a ValueEnum item, any string is accepted when empty
+	EnumValues []string
+	// TriggerMode tells if FireEvent sets the value, signal only by default for UsesTriggers drivers
+	TriggerMode TriggerMode
+
+	// Driver of the item type, nil when no driver is known
+	Driver *driver.DriverItem
+
+	dc          *Dbus
+	properties  *prop.Properties
+	log         *logging.Logger
+	quality     Quality
+	lastUpdated time.Time
+	staleTimer  *time.Timer
+	targetID    uint64
+	targetState TargetState
+	targetTimer *time.Timer
+	history     []HistoryEntry
+	historyLen  int
+	historyNext int
+	stopPoll    context.CancelFunc
+
+	stateTimer    *time.Timer
+	awaitingState bool
+	resetTimer    *time.Timer
+	eventSeq      uint64
+	// publishMu keeps the properties in the order the fields were set
+	publishMu sync.Mutex
 
 	setItemOptionCb interface{ SetItemOptions(*Item) }
 	setItemTargetCb interface{ SetItemTarget(*Item, []byte) }
+
+	setItemTranslatedTargetCb interface{ SetItemTranslatedTarget(*Item, interface{}) }
+	pollItemCB                interface{ PollItem(*Item, string) }
+	requestStateCB            interface{ RequestState(*Item, string) }
+
+	changeItemOptionsCB ItemOptionsChanger
+
+	targetWriterCB           TargetWriter
+	translatedTargetWriterCB TranslatedTargetWriter
 }
 
-func initItem(itemID string, typeID string, typeVersion string, options []byte, d *Device) *Item {
+// newItem creates an item not yet added to the device
+// The ItemValueKind callback is called here, without any lock held
+func newItem(itemID string, typeID string, typeVersion string, options []byte, d *Device) *Item {
 	i := &Item{
 		ItemID:      itemID,
 		Mac:         d.Address,
 		TypeID:      typeID,
 		TypeVersion: typeVersion,
 		Options:     options,
+		Operability: OperabilityUnknown,
+		quality:     QualityUncertain,
+		targetState: TargetIdle,
 		log:         d.log,
 		Device:      d,
 		dc:          d.dc,
 	}
 
-	d.Items[itemID] = i
+	if i.dc.Drivers != nil {
+		if driver, ok := i.dc.Drivers.GetDriverItem(typeID, typeVersion); ok {
+			i.Driver = driver
+			if usesTriggers := driver.HDesc.UsesTriggers; usesTriggers != nil && *usesTriggers {
+				i.TriggerMode = TriggerSignalOnly
+			}
+		}
+	}
+
+	switch cb := d.Protocol.cbs.(type) {
+	case interface{ ItemValueKind(*Item) ValueKind }:
+		i.ValueKind = cb.ItemValueKind(i)
+	}
+
+	return i
+}
+
+// initItem adds the item to its device and exports it, the device lock must be held
+func initItem(i *Item) {
+	d := i.Device
+	d.Items[i.ItemID] = i
 
 	if i.dc.conn == nil {
 		i.dc.Log.Warning("Unable to export dbus object because dbus connection nil")
@@ -57,46 +127,207 @@ func initItem(itemID string, typeID string, typeVersion string, options []byte,
 	i.SetDbusProperties(nil)
 	i.SetDbusMethods(nil)
 	i.SetCallbacks(d.Protocol.cbs)
+	i.startPolling()
 
 	if !isNil(d.addItemCB) {
 		go d.addItemCB.AddItem(i)
 	}
 
 	i.EmitDbusSignal(signalItemAdded, i.TypeID, i.TypeVersion, i.Options)
-
-	return i
+	i.dc.snapshotChanged()
 }
 
 func removeItem(i *Item) {
 	d := i.Device
 	path := dbus.ObjectPath(dbusPathPrefix + i.Device.Protocol.protocolName + "/" + i.Device.DevID + "/" + i.ItemID)
 
+	i.stopPolling()
+	i.stopStaleTimer()
+	i.stopTargetTimer()
+	i.stopStateTimer()
+	i.stopResetTimer()
 	if !isNil(i.Device.removeItemCB) {
 		go d.removeItemCB.RemoveItem(d.DevID, i.ItemID)
 	}
 	delete(d.Items, i.ItemID)
 	d.dc.conn.Emit(path, dbusItemInterface+"."+signalItemRemoved)
 	d.dc.conn.Export(nil, path, dbusItemInterface)
+	d.dc.snapshotChanged()
+}
+
+// setOptions is the dbus write of the property Options, it is decided before the properties are locked
+func (i *Item) setOptions(options []byte) *dbus.Error {
+	return i.changeOptions(options, false)
 }
 
-func (i *Item) setItemOptions(c *prop.Change) *dbus.Error {
+// MergeOptions is the dbus method to update a part of the options with a JSON merge patch (RFC 7386)
+func (i *Item) MergeOptions(patch []byte) *dbus.Error {
+	i.log.Info("MergeOptions called - itemID:", i.ItemID, "patch:", string(patch))
+	return i.changeOptions(patch, true)
+}
+
+// changeOptions validates the new options, lets the protocol app veto them, then stores and publishes them
+// When merge is true, change is a JSON merge patch applied to the current options
+// No lock is held during the veto, the change is decided again if the options changed meanwhile
+func (i *Item) changeOptions(change []byte, merge bool) *dbus.Error {
+	var oldOptions, options []byte
+	for stored := false; !stored; {
+		oldOptions = i.GetOptions()
+		options = change
+		if merge {
+			merged, err := mergePatch(oldOptions, change)
+			if err != nil {
+				i.log.Warning("Options patch of the item", i.ItemID, "not valid:", err)
+				return dbus.NewError(errInvalidArgs, []interface{}{err.Error()})
+			}
+			options = merged
+		}
+
+		if err := i.dc.validateItemOptions(i.TypeID, i.TypeVersion, options); err != nil {
+			i.log.Warning("Options of the item", i.ItemID, "refused:", err.Error())
+			return err
+		}
+		if !isNil(i.changeItemOptionsCB) {
+			if err := i.changeItemOptionsCB.ChangeItemOptions(i, oldOptions, options); err != nil {
+				i.log.Warning("Options of the item", i.ItemID, "vetoed:", err)
+				return dbus.NewError(errInvalidArgs, []interface{}{err.Error()})
+			}
+		}
+
+		i.Lock()
+		stored = bytes.Equal(i.Options, oldOptions)
+		if stored {
+			i.Options = options
+		}
+		i.Unlock()
+	}
+	i.log.Info("propertyOptions of the item", i.ItemID, "changed from", string(oldOptions), "to", string(options))
+	i.dc.snapshotChanged()
+	i.publishOptions()
+
 	if !isNil(i.setItemOptionCb) {
 		go i.setItemOptionCb.SetItemOptions(i)
-	} else {
-		i.log.Warning("No Options")
 	}
 	return nil
 }
 
+// publishOptions sets the property Options to the stored options
+func (i *Item) publishOptions() {
+	if i.properties == nil {
+		return
+	}
+	i.publishMu.Lock()
+	i.properties.SetMust(dbusItemInterface, propertyOptions, i.GetOptions())
+	i.publishMu.Unlock()
+}
+
 func (i *Item) setItemTarget(c *prop.Change) *dbus.Error {
-	if !isNil(i.setItemTargetCb) {
-		go i.setItemTargetCb.SetItemTarget(i, c.Value.([]byte))
+	value := c.Value
+	if v, ok := value.(dbus.Variant); ok {
+		value = v.Value()
+	}
+	dbusValue, err := i.coerce(value)
+	if err != nil {
+		i.log.Warning("Target of the item", i.ItemID, "not valid:", err)
+		return &dbus.ErrMsgInvalidArg
+	}
+	target, err := encodeValue(i.ValueKind, dbusValue)
+	if err != nil {
+		i.log.Warning("Fail to encode the target of the item", i.ItemID, err)
+		return &dbus.ErrMsgInvalidArg
+	}
+
+	i.Lock()
+	i.Target = target
+	i.Unlock()
+
+	if !isNil(i.Device.sendCB) {
+		value, err := i.DecodeTarget()
+		if err != nil {
+			i.log.Warning("Fail to decode the target of the item", i.ItemID, err)
+			return &dbus.ErrMsgInvalidArg
+		}
+		id := i.startTarget()
+		i.Device.enqueue(&Command{Item: i, TargetID: id, Target: target, Value: value})
+		go i.publishTargetState()
+		return nil
+	}
+
+	// The legacy callbacks do not know the target id, their targets are only tracked on demand
+	var send func(id uint64)
+	tracked := true
+	if i.Driver != nil && (!isNil(i.translatedTargetWriterCB) || !isNil(i.setItemTranslatedTargetCb)) {
+		value, err := i.DecodeTarget()
+		if err != nil {
+			i.log.Warning("Fail to decode the target of the item", i.ItemID, err)
+			return &dbus.ErrMsgInvalidArg
+		}
+		if !isNil(i.translatedTargetWriterCB) {
+			send = func(id uint64) { i.translatedTargetWriterCB.SetItemTranslatedTargetWithID(i, id, value) }
+		} else {
+			send = func(uint64) { i.setItemTranslatedTargetCb.SetItemTranslatedTarget(i, value) }
+			tracked = i.Device.Protocol.TrackLegacyTargets
+		}
+	} else if !isNil(i.targetWriterCB) {
+		send = func(id uint64) { i.targetWriterCB.SetItemTargetWithID(i, id, target) }
+	} else if !isNil(i.setItemTargetCb) {
+		send = func(uint64) { i.setItemTargetCb.SetItemTarget(i, target) }
+		tracked = i.Device.Protocol.TrackLegacyTargets
 	} else {
 		i.log.Warning("No Target callback")
+		return nil
+	}
+
+	var id uint64
+	if tracked {
+		id = i.startTarget()
 	}
+	go func() {
+		// The properties can not be updated while the dbus Set call holds them
+		if tracked {
+			i.publishTargetState()
+		}
+		send(id)
+		i.targetSent()
+	}()
 	return nil
 }
 
+// PublishRaw translates a raw frame with the read translation of the item driver, then sets the value
+func (i *Item) PublishRaw(frame interface{}) {
+	value := frame
+	if i.Driver != nil {
+		value = i.Driver.Read.Translate(frame)
+	}
+
+	i.setTypedValue(value)
+}
+
+// DecodeTarget returns the current target translated with the write translation of the item driver
+func (i *Item) DecodeTarget() (interface{}, error) {
+	target := i.GetTarget()
+
+	var value interface{}
+	if i.ValueKind == ValueBytes {
+		if err := json.Unmarshal(target, &value); err != nil {
+			value = driver.ParseValue(string(target))
+		}
+	} else {
+		var err error
+		if value, err = i.decodeValue(target); err != nil {
+			return nil, err
+		}
+	}
+
+	if i.Driver == nil {
+		return value, nil
+	}
+	if value == nil {
+		return nil, errors.New(msgBodyNotValid)
+	}
+	return i.Driver.Write.Translate(value), nil
+}
+
 // EmitDbusSignal emit a dbus signal from item object
 func (i *Item) EmitDbusSignal(sigName string, args ...interface{}) {
 	path := dbus.ObjectPath(dbusPathPrefix + i.Device.Protocol.protocolName + "/" + i.Device.DevID + "/" + i.ItemID)
@@ -110,15 +341,47 @@ func (i *Item) SetCallbacks(cbs interface{}) {
 		i.setItemOptionCb = cb
 	}
 	switch cb := cbs.(type) {
+	case ItemOptionsChanger:
+		i.changeItemOptionsCB = cb
+	}
+	switch cb := cbs.(type) {
 	case interface{ SetItemTarget(*Item, []byte) }:
 		i.setItemTargetCb = cb
 	}
+	switch cb := cbs.(type) {
+	case interface{ SetItemTranslatedTarget(*Item, interface{}) }:
+		i.setItemTranslatedTargetCb = cb
+	}
+	switch cb := cbs.(type) {
+	case TargetWriter:
+		i.targetWriterCB = cb
+	}
+	switch cb := cbs.(type) {
+	case TranslatedTargetWriter:
+		i.translatedTargetWriterCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface{ PollItem(*Item, string) }:
+		i.pollItemCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface{ RequestState(*Item, string) }:
+		i.requestStateCB = cb
+	}
 }
 
 // SetDbusMethods set new dbusMethods for this Item
 func (i *Item) SetDbusMethods(externalMethods map[string]interface{}) bool {
 	path := dbus.ObjectPath(dbusPathPrefix + i.Device.Protocol.protocolName + "/" + i.Device.DevID + "/" + i.ItemID)
-	err := i.Device.Protocol.dc.conn.ExportMethodTable(externalMethods, path, dbusItemInterface)
+	exportedMethods := make(map[string]interface{})
+	exportedMethods["GetHistory"] = i.GetHistory
+	exportedMethods["MergeOptions"] = i.MergeOptions
+
+	for name, inter := range externalMethods {
+		exportedMethods[name] = inter
+	}
+
+	err := i.Device.Protocol.dc.conn.ExportMethodTable(exportedMethods, path, dbusItemInterface)
 	if err != nil {
 		i.log.Warning("Fail to export item dbus object", i.ItemID, err)
 		return false
@@ -135,16 +398,52 @@ func (i *Item) SetDbusProperties(externalProperties map[string]*prop.Prop) bool
 				Value:    i.Options,
 				Writable: true,
 				Emit:     prop.EmitTrue,
-				Callback: i.setItemOptions,
+				Callback: nil,
 			},
 			propertyTarget: {
-				Value:    i.Target,
+				Value:    i.exportedValue(i.Target),
 				Writable: true,
 				Emit:     prop.EmitTrue,
 				Callback: i.setItemTarget,
 			},
 			propertyValue: {
-				Value:    i.Value,
+				Value:    i.exportedValue(i.Value),
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyOperabilityState: {
+				Value:    i.Operability,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyTargetState: {
+				Value:    i.targetState,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyTargetID: {
+				Value:    i.targetID,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyLastUpdated: {
+				Value:    int64(0),
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyLastUpdatedMonotonic: {
+				Value:    uint64(0),
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
+			propertyQuality: {
+				Value:    i.quality,
 				Writable: false,
 				Emit:     prop.EmitTrue,
 				Callback: nil,
@@ -156,7 +455,7 @@ func (i *Item) SetDbusProperties(externalProperties map[string]*prop.Prop) bool
 		propsSpec[dbusDeviceInterface][pName] = p
 	}
 
-	properties, err := prop.Export(i.dc.conn, path, propsSpec)
+	properties, err := i.dc.exportProperties(path, propsSpec, dbusItemInterface, i.setOptions)
 	if err == nil {
 		i.properties = properties
 	} else {
@@ -172,40 +471,67 @@ func (i *Item) SetOption(options []byte) {
 		return
 	}
 
-	oldVariant, err := i.properties.Get(dbusItemInterface, propertyOptions)
-
-	if err != nil {
+	i.Lock()
+	oldState := i.Options
+	if bytes.Equal(oldState, options) {
+		i.Unlock()
 		return
 	}
+	i.Options = options
+	i.Unlock()
 
-	oldState := oldVariant.Value().([]byte)
-	newState := []byte(options)
-	if bytes.Equal(oldState, newState) {
-		return
-	}
+	i.log.Info("propertyOptions of the item", i.ItemID, "changed from", string(oldState), "to", string(options))
+	i.dc.snapshotChanged()
+	i.publishOptions()
+}
+
+// GetOptions returns the options of the item
+func (i *Item) GetOptions() []byte {
+	i.Lock()
+	defer i.Unlock()
+	return i.Options
+}
 
-	i.log.Info("propertyOptions of the item", i.ItemID, "changed from", string(oldState), "to", string(newState))
-	i.properties.SetMust(dbusItemInterface, propertyOptions, newState)
+// GetValue returns the bytes of the current value of the item
+func (i *Item) GetValue() []byte {
+	i.Lock()
+	defer i.Unlock()
+	return i.Value
+}
+
+// GetTarget returns the bytes of the last target received by the item
+func (i *Item) GetTarget() []byte {
+	i.Lock()
+	defer i.Unlock()
+	return i.Target
 }
 
 // SetValue set the value of the property Value
+// For a typed item, value is decoded according to the ValueKind of the item
 func (i *Item) SetValue(value []byte) {
-	if i.properties == nil {
+	dbusValue, err := i.decodeValue(value)
+	if err != nil {
+		i.log.Warning("Value of the item", i.ItemID, "not valid:", err)
 		return
 	}
-
-	oldVariant, err := i.properties.Get(dbusItemInterface, propertyValue)
-
+	// Value keeps the same representation whatever the setter used
+	data, err := encodeValue(i.ValueKind, dbusValue)
 	if err != nil {
+		i.log.Warning("Fail to encode the value of the item", i.ItemID, err)
 		return
 	}
+	i.updateValue(data, dbusValue)
+}
 
-	oldState := oldVariant.Value().([]byte)
-	newState := []byte(value)
-	if bytes.Equal(oldState, newState) {
-		return
+// exportedValue returns the dbus representation of the bytes of Value or Target
+func (i *Item) exportedValue(data []byte) interface{} {
+	if i.ValueKind == ValueBytes {
+		return data
 	}
-
-	i.log.Info("propertyValue of the item", i.ItemID, "changed from", string(oldState), "to", string(newState))
-	i.properties.SetMust(dbusItemInterface, propertyValue, newState)
+	if data != nil {
+		if dbusValue, err := i.decodeValue(data); err == nil {
+			return dbusValue
+		}
+	}
+	return i.ValueKind.zero()
 }
@@ -0,0 +1,120 @@
+package dbusconn
+
+import (
+	"context"
+	"time"
+)
+
+// Pinger is implemented by the protocol app to check that a protocol or a bridge answers
+type Pinger interface {
+	Ping(context.Context) error
+}
+
+// MonitorConfig tells how often the reachability of a protocol is checked
+type MonitorConfig struct {
+	// Interval time between two pings
+	Interval time.Duration
+	// Timeout time given to each ping
+	Timeout time.Duration
+	// FailThreshold number of consecutive failed pings before the protocol goes KO
+	FailThreshold int
+	// SuccessThreshold number of consecutive successful pings before the protocol goes OK
+	SuccessThreshold int
+}
+
+var defaultMonitorConfig = MonitorConfig{
+	Interval:         30 * time.Second,
+	Timeout:          5 * time.Second,
+	FailThreshold:    3,
+	SuccessThreshold: 1,
+}
+
+// StartReachabilityMonitor pings the protocol periodically and sets its ReachabilityState
+// The zero fields of config take their default value
+// The ReachabilityRule is suspended while the monitor runs
+// When the protocol goes KO, all its devices go KO until they publish a value again
+func (p *Protocol) StartReachabilityMonitor(pinger Pinger, config MonitorConfig) {
+	if config.Interval <= 0 {
+		config.Interval = defaultMonitorConfig.Interval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultMonitorConfig.Timeout
+	}
+	if config.FailThreshold <= 0 {
+		config.FailThreshold = defaultMonitorConfig.FailThreshold
+	}
+	if config.SuccessThreshold <= 0 {
+		config.SuccessThreshold = defaultMonitorConfig.SuccessThreshold
+	}
+
+	p.StopReachabilityMonitor()
+
+	ctx, cancel := context.WithCancel(p.dc.context())
+	p.Lock()
+	p.stopMonitor = cancel
+	p.Unlock()
+
+	go p.monitor(ctx, pinger, config)
+}
+
+// StopReachabilityMonitor stops the monitor started by StartReachabilityMonitor
+// and lets the ReachabilityRule drive the ReachabilityState again
+func (p *Protocol) StopReachabilityMonitor() {
+	p.Lock()
+	stopped := p.stopMonitor != nil
+	if stopped {
+		p.stopMonitor()
+		p.stopMonitor = nil
+	}
+	p.Unlock()
+
+	if stopped {
+		p.updateReachability()
+	}
+}
+
+func (p *Protocol) monitor(ctx context.Context, pinger Pinger, config MonitorConfig) {
+	ticker := time.NewTicker(config.Interval)
+	defer ticker.Stop()
+
+	var successes, failures int
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, config.Timeout)
+		err := pinger.Ping(pingCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err == nil {
+			successes++
+			failures = 0
+		} else {
+			p.log.Debug("Ping of the protocol", p.protocolName, "failed:", err)
+			failures++
+			successes = 0
+		}
+
+		state := p.GetReachability()
+		if successes >= config.SuccessThreshold && state != ReachabilityOk {
+			p.setReachability(ReachabilityOk)
+		} else if failures >= config.FailThreshold && state != ReachabilityKo {
+			p.log.Warning("Protocol", p.protocolName, "unreachable:", err)
+			p.setReachability(ReachabilityKo)
+			p.setDevicesLost()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// setDevicesLost sets all the devices of the protocol KO
+func (p *Protocol) setDevicesLost() {
+	for _, d := range p.devices() {
+		d.setLost()
+	}
+}
@@ -0,0 +1,62 @@
+package dbusconn
+
+// SetOperabilityState set the value of the property OperabilityState of the item
+// The OperabilityState of the device is then derived from the ones of its items
+func (i *Item) SetOperabilityState(state OperabilityState) {
+	if i.properties == nil {
+		return
+	}
+
+	i.publishMu.Lock()
+	i.Lock()
+	oldState := i.Operability
+	if oldState == state {
+		i.Unlock()
+		i.publishMu.Unlock()
+		return
+	}
+	i.Operability = state
+	i.Unlock()
+
+	i.log.Info("OperabilityState of the item", i.ItemID, "changed from", oldState, "to", state)
+	i.properties.SetMust(dbusItemInterface, propertyOperabilityState, state)
+	i.publishMu.Unlock()
+	i.Device.updateOperability()
+}
+
+// GetOperability returns the value of the property OperabilityState of the item
+func (i *Item) GetOperability() OperabilityState {
+	i.Lock()
+	defer i.Unlock()
+	return i.Operability
+}
+
+// updateOperability derives the OperabilityState of the device from the ones of its items
+// Items in an unknown state are ignored, the device state is left untouched when no item state is known
+func (d *Device) updateOperability() {
+	d.Lock()
+	var ok, ko, known int
+	for _, i := range d.Items {
+		switch i.GetOperability() {
+		case OperabilityOk:
+			ok++
+		case OperabilityKo:
+			ko++
+		case OperabilityUnknown:
+			continue
+		}
+		known++
+	}
+	d.Unlock()
+
+	switch {
+	case known == 0:
+		return
+	case ok == known:
+		d.SetOperabilityState(OperabilityOk)
+	case ko == known:
+		d.SetOperabilityState(OperabilityKo)
+	default:
+		d.SetOperabilityState(OperabilityPartial)
+	}
+}
@@ -0,0 +1,136 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+)
+
+const errInvalidArgs = "org.freedesktop.DBus.Error.InvalidArgs"
+
+// DeviceOptionsChanger and ItemOptionsChanger let the protocol app veto new options, from a D-Bus write
+// or MergeOptions, by returning an error. The old and new options are given as JSON.
+// The veto is called without any lock held, so it may call the device or the item. When the options
+// change while it runs, it is called again with the current options as the old ones.
+type (
+	DeviceOptionsChanger interface {
+		ChangeDeviceOptions(d *Device, oldOptions []byte, newOptions []byte) error
+	}
+	ItemOptionsChanger interface {
+		ChangeItemOptions(i *Item, oldOptions []byte, newOptions []byte) error
+	}
+)
+
+// optionsProperties is exported instead of the prop.Properties of a device or an item so that
+// a write of Options is decided before prop locks the properties, the other writes go to prop
+type optionsProperties struct {
+	*prop.Properties
+	iface      string
+	setOptions func([]byte) *dbus.Error
+}
+
+// Set implements org.freedesktop.DBus.Properties.Set
+func (p optionsProperties) Set(iface string, property string, value dbus.Variant) *dbus.Error {
+	if iface != p.iface || property != propertyOptions {
+		return p.Properties.Set(iface, property, value)
+	}
+	options, ok := value.Value().([]byte)
+	if !ok {
+		return prop.ErrInvalidArg
+	}
+	return p.setOptions(options)
+}
+
+// exportProperties exports the properties of a device or an item, the writes of Options go to setOptions
+func (dc *Dbus) exportProperties(path dbus.ObjectPath, props map[string]map[string]*prop.Prop, iface string, setOptions func([]byte) *dbus.Error) (*prop.Properties, error) {
+	properties, err := prop.Export(dc.conn, path, props)
+	if err != nil {
+		return nil, err
+	}
+	err = dc.conn.Export(optionsProperties{properties, iface, setOptions}, path, "org.freedesktop.DBus.Properties")
+	return properties, err
+}
+
+// validateDeviceOptions checks that the options are JSON and match the schema of the device type, if any
+// Empty options are checked as an empty object
+func (dc *Dbus) validateDeviceOptions(typeID string, typeVersion string, options []byte) *dbus.Error {
+	if err := malformedOptions(options); err != nil || dc.Drivers == nil {
+		return err
+	}
+	return invalidOptions(dc.Drivers.DeviceOptionsSchema(typeID, typeVersion), options)
+}
+
+// validateItemOptions checks that the options are JSON and match the schema of the item type, if any
+// Empty options are checked as an empty object
+func (dc *Dbus) validateItemOptions(typeID string, typeVersion string, options []byte) *dbus.Error {
+	if err := malformedOptions(options); err != nil || dc.Drivers == nil {
+		return err
+	}
+	return invalidOptions(dc.Drivers.ItemOptionsSchema(typeID, typeVersion), options)
+}
+
+// malformedOptions refuses the options which are not JSON, whether a schema exists or not
+func malformedOptions(options []byte) *dbus.Error {
+	if len(options) > 0 && !json.Valid(options) {
+		return dbus.NewError(errInvalidArgs, []interface{}{"options not valid: malformed JSON"})
+	}
+	return nil
+}
+
+func invalidOptions(schema interface{ Validate([]byte) []error }, options []byte) *dbus.Error {
+	if isNil(schema) {
+		return nil
+	}
+	if len(options) == 0 {
+		options = []byte("{}")
+	}
+
+	errs := schema.Validate(options)
+	if len(errs) == 0 {
+		return nil
+	}
+
+	msgs := make([]string, len(errs))
+	for index, err := range errs {
+		msgs[index] = err.Error()
+	}
+	return dbus.NewError(errInvalidArgs, []interface{}{"options not valid: " + strings.Join(msgs, "; ")})
+}
+
+// mergePatch applies the JSON merge patch (RFC 7386) to the JSON document target
+// Empty or non object target are replaced by an empty object
+func mergePatch(target []byte, patch []byte) ([]byte, error) {
+	var patchValue interface{}
+	if err := json.Unmarshal(patch, &patchValue); err != nil {
+		return nil, err
+	}
+
+	var targetValue interface{}
+	if len(target) > 0 {
+		json.Unmarshal(target, &targetValue)
+	}
+
+	return json.Marshal(mergeValue(targetValue, patchValue))
+}
+
+func mergeValue(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = make(map[string]interface{})
+	}
+	for name, value := range patchObject {
+		if value == nil {
+			delete(targetObject, name)
+		} else {
+			targetObject[name] = mergeValue(targetObject[name], value)
+		}
+	}
+	return targetObject
+}
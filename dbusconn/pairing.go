@@ -0,0 +1,110 @@
+package dbusconn
+
+import (
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	defaultPairingTimeout = 60 * time.Second
+)
+
+var errPairingNotNeeded = dbus.NewError("org.freedesktop.DBus.Error.NotSupported", []interface{}{"pairing not needed"})
+
+// StartPairing is the dbus method to start the pairing of the device
+// The pairing fails if the protocol app does not set the PairingState before timeoutSec, 0 means the default timeout
+func (d *Device) StartPairing(timeoutSec uint32) *dbus.Error {
+	d.log.Info("StartPairing called - devID:", d.DevID, "timeout:", timeoutSec)
+	if d.GetPairingState() == PairingNotNeeded {
+		return errPairingNotNeeded
+	}
+
+	timeout := time.Duration(timeoutSec) * time.Second
+	if timeout == 0 && d.Driver != nil {
+		timeout = d.Driver.PairingTimeout
+	}
+	if timeout == 0 {
+		timeout = defaultPairingTimeout
+	}
+
+	d.Lock()
+	if d.pairingTimer != nil {
+		d.pairingTimer.Stop()
+	}
+	d.pairingTimer = time.AfterFunc(timeout, d.pairingTimeout)
+	d.Unlock()
+
+	d.SetPairingState(PairingInProgress)
+	if !isNil(d.startPairingCB) {
+		go d.startPairingCB.StartPairing(d, timeout)
+	}
+	return nil
+}
+
+// CancelPairing is the dbus method to cancel the pairing in progress
+func (d *Device) CancelPairing() *dbus.Error {
+	d.log.Info("CancelPairing called - devID:", d.DevID)
+	if d.GetPairingState() != PairingInProgress {
+		return nil
+	}
+
+	d.stopPairingTimer()
+	d.SetPairingState(PairingUnknown)
+	if !isNil(d.cancelPairingCB) {
+		go d.cancelPairingCB.CancelPairing(d)
+	}
+	return nil
+}
+
+// Unpair is the dbus method to remove the pairing of the device
+func (d *Device) Unpair() *dbus.Error {
+	d.log.Info("Unpair called - devID:", d.DevID)
+	if d.GetPairingState() == PairingNotNeeded {
+		return errPairingNotNeeded
+	}
+
+	d.stopPairingTimer()
+	d.SetPairingState(PairingUnknown)
+	if !isNil(d.unpairCB) {
+		go d.unpairCB.Unpair(d)
+	}
+	return nil
+}
+
+func (d *Device) pairingTimeout() {
+	if d.GetPairingState() != PairingInProgress {
+		return
+	}
+	d.log.Warning("Pairing of the device", d.DevID, "timed out")
+	d.SetPairingState(PairingKo)
+}
+
+func (d *Device) stopPairingTimer() {
+	d.Lock()
+	if d.pairingTimer != nil {
+		d.pairingTimer.Stop()
+		d.pairingTimer = nil
+	}
+	d.Unlock()
+}
+
+// updatePairingNeeded sets the PairingState to NOT_NEEDED when the drivers of all the items do not need pairing
+func (d *Device) updatePairingNeeded() {
+	d.Lock()
+	needed := len(d.Items) == 0
+	for _, i := range d.Items {
+		if i.Driver == nil || i.Driver.PairingNeeded {
+			needed = true
+			break
+		}
+	}
+	d.Unlock()
+
+	state := d.GetPairingState()
+	if !needed && state == PairingUnknown {
+		d.SetPairingState(PairingNotNeeded)
+	} else if needed && state == PairingNotNeeded {
+		d.SetPairingState(PairingUnknown)
+	}
+}
@@ -2,6 +2,7 @@ package dbusconn
 
 import (
 	"sync"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/prop"
@@ -31,6 +32,17 @@ type Protocol struct {
 	BridgeID     string
 	Devices      map[string]*Device
 	Reachability ReachabilityState
+	// HistorySize number of values kept by each item of the protocol, 0 disables the history
+	HistorySize int
+	// TargetTimeout time given to the protocol app to acknowledge a target
+	TargetTimeout time.Duration
+	// TrackLegacyTargets tracks the targets sent with SetItemTarget or SetItemTranslatedTarget,
+	// the protocol app then acknowledges them with CurrentTargetID, otherwise they stay IDLE
+	TrackLegacyTargets bool
+	// CommandRetry tells how the commands are sent when the protocol app implements Sender
+	CommandRetry RetryPolicy
+	// ReachabilityRule tells how ReachabilityState is derived from the devices, not derived by default
+	ReachabilityRule ReachabilityRule
 
 	ready          bool
 	log            *logging.Logger
@@ -41,6 +53,16 @@ type Protocol struct {
 	removeDeviceCB interface{ RemoveDevice(string) }
 	cbs            interface{}
 	isBridged      bool
+
+	reachabilityOverridden bool
+	stopMonitor            func()
+
+	inclusionActive  bool
+	inclusionTimer   *time.Timer
+	startInclusionCB interface {
+		StartInclusion(*Protocol, time.Duration)
+	}
+	stopInclusionCB interface{ StopInclusion(*Protocol) }
 	sync.Mutex
 }
 
@@ -69,13 +91,16 @@ func (dc *Dbus) initRootProtocol(cbs interface{}) *Protocol {
 	dc.RootProtocol.log = dc.Log
 
 	dc.RootProtocol.Protocol = &Protocol{ready: false,
-		dc:           dc,
-		Devices:      make(map[string]*Device),
-		log:          dc.Log,
-		protocolName: dc.ProtocolName,
-		Reachability: ReachabilityUnknown,
-		cbs:          cbs,
-		isBridged:    false,
+		dc:            dc,
+		Devices:       make(map[string]*Device),
+		log:           dc.Log,
+		protocolName:  dc.ProtocolName,
+		Reachability:  ReachabilityUnknown,
+		HistorySize:   defaultHistorySize,
+		TargetTimeout: defaultTargetTimeout,
+		CommandRetry:  defaultRetryPolicy,
+		cbs:           cbs,
+		isBridged:     false,
 	}
 
 	if !dc.RootProtocol.Protocol.SetDbusProperties(nil) {
@@ -113,14 +138,19 @@ func (r *RootProto) AddBridge(bridgeID string) (bool, *dbus.Error) {
 	_, alreadyAdded := r.dc.Bridges[bridgeID]
 	if !alreadyAdded {
 		var p = &Protocol{ready: false,
-			dc:           r.dc,
-			Devices:      make(map[string]*Device),
-			log:          r.log,
-			protocolName: protoName,
-			Reachability: ReachabilityUnknown,
-			cbs:          r.Protocol.cbs,
-			isBridged:    true,
-			BridgeID:     bridgeID,
+			dc:                 r.dc,
+			Devices:            make(map[string]*Device),
+			log:                r.log,
+			protocolName:       protoName,
+			Reachability:       ReachabilityUnknown,
+			HistorySize:        r.Protocol.HistorySize,
+			TargetTimeout:      r.Protocol.TargetTimeout,
+			TrackLegacyTargets: r.Protocol.TrackLegacyTargets,
+			CommandRetry:       r.Protocol.CommandRetry,
+			ReachabilityRule:   r.Protocol.ReachabilityRule,
+			cbs:                r.Protocol.cbs,
+			isBridged:          true,
+			BridgeID:           bridgeID,
 		}
 
 		p.SetDbusProperties(nil)
@@ -133,6 +163,7 @@ func (r *RootProto) AddBridge(bridgeID string) (bool, *dbus.Error) {
 			go r.addBridgeCB.AddBridge(p)
 		}
 		p.EmitDbusSignal(signalBridgeAdded)
+		r.dc.snapshotChanged()
 	}
 	r.Protocol.Unlock()
 	return alreadyAdded, nil
@@ -141,12 +172,20 @@ func (r *RootProto) AddBridge(bridgeID string) (bool, *dbus.Error) {
 // AddDevice is the dbus method to add a new device
 func (p *Protocol) AddDevice(devID string, comID string, typeID string, typeVersion string, options []byte) (bool, *dbus.Error) {
 	p.log.Info("AddDevice called - devID:", devID, "comID:", comID, "typeID:", typeID, "typeVersion:", options, "typeVersion:", options)
+	if err := p.dc.validateDeviceOptions(typeID, typeVersion, options); err != nil {
+		p.log.Warning("Device", devID, "refused:", err.Error())
+		return false, err
+	}
 	p.Lock()
 	_, alreadyAdded := p.Devices[devID]
+	var d *Device
 	if !alreadyAdded {
-		initDevice(devID, comID, typeID, typeVersion, options, p)
+		d = initDevice(devID, comID, typeID, typeVersion, options, p)
 	}
 	p.Unlock()
+	if d != nil {
+		d.applyDeviceDriver()
+	}
 	return alreadyAdded, nil
 }
 
@@ -169,6 +208,7 @@ func (r *RootProto) RemoveBridge(bridgeID string) *dbus.Error {
 		return nil
 	}
 
+	bridge.Protocol.StopReachabilityMonitor()
 	for device := range bridge.Protocol.Devices {
 		bridge.Protocol.RemoveDevice(device)
 	}
@@ -182,6 +222,7 @@ func (r *RootProto) RemoveBridge(bridgeID string) *dbus.Error {
 	r.dc.conn.Emit(path, dbusProtocolInterface+"."+signalBridgeRemoved)
 	r.dc.conn.Export(nil, path, dbusProtocolInterface)
 	r.Protocol.Unlock()
+	r.dc.snapshotChanged()
 	return nil
 }
 
@@ -194,9 +235,31 @@ func (p *Protocol) RemoveDevice(devID string) *dbus.Error {
 		removeDevice(d)
 	}
 	p.Unlock()
+	if devicePresent {
+		p.updateReachability()
+	}
 	return nil
 }
 
+// device returns the device devID of the protocol
+func (p *Protocol) device(devID string) (*Device, bool) {
+	p.Lock()
+	defer p.Unlock()
+	d, ok := p.Devices[devID]
+	return d, ok
+}
+
+// devices returns the devices of the protocol
+func (p *Protocol) devices() []*Device {
+	p.Lock()
+	defer p.Unlock()
+	devices := make([]*Device, 0, len(p.Devices))
+	for _, d := range p.Devices {
+		devices = append(devices, d)
+	}
+	return devices
+}
+
 // EmitDbusSignal emit a dbus signal from protocol object
 func (p *Protocol) EmitDbusSignal(sigName string, args ...interface{}) {
 	path := dbus.ObjectPath(dbusPathPrefix + p.protocolName)
@@ -219,6 +282,8 @@ func (p *Protocol) SetDbusMethods(externalMethods map[string]interface{}) bool {
 	exportedMethods["IsReady"] = p.IsReady
 	exportedMethods["AddDevice"] = p.AddDevice
 	exportedMethods["RemoveDevice"] = p.RemoveDevice
+	exportedMethods["StartInclusion"] = p.StartInclusion
+	exportedMethods["StopInclusion"] = p.StopInclusion
 	if !p.isBridged {
 		exportedMethods["AddBridge"] = p.dc.RootProtocol.AddBridge
 		exportedMethods["RemoveBridge"] = p.dc.RootProtocol.RemoveBridge
@@ -247,6 +312,12 @@ func (p *Protocol) SetDbusProperties(externalProperties map[string]*prop.Prop) b
 				Emit:     prop.EmitTrue,
 				Callback: nil,
 			},
+			propertyInclusionActive: {
+				Value:    p.inclusionActive,
+				Writable: false,
+				Emit:     prop.EmitTrue,
+				Callback: nil,
+			},
 		},
 	}
 
@@ -284,23 +355,48 @@ func (p *Protocol) SetProtocolCBs(cbs interface{}) {
 	case interface{ RemoveDevice(string) }:
 		p.removeDeviceCB = cb
 	}
+	switch cb := cbs.(type) {
+	case interface {
+		StartInclusion(*Protocol, time.Duration)
+	}:
+		p.startInclusionCB = cb
+	}
+	switch cb := cbs.(type) {
+	case interface{ StopInclusion(*Protocol) }:
+		p.stopInclusionCB = cb
+	}
 }
 
 // SetReachabilityState set the value of the property ReachabilityState
+// The state set by the protocol app overrides the ReachabilityRule until ClearReachabilityOverride
 func (p *Protocol) SetReachabilityState(state ReachabilityState) {
-	if p.properties == nil {
-		return
-	}
+	p.Lock()
+	p.reachabilityOverridden = true
+	p.Unlock()
 
-	oldVariant, err := p.properties.Get(dbusProtocolInterface, propertyReachabilityState)
-	if err != nil {
+	p.setReachability(state)
+}
+
+// GetReachability returns the value of the property ReachabilityState
+func (p *Protocol) GetReachability() ReachabilityState {
+	p.Lock()
+	defer p.Unlock()
+	return p.Reachability
+}
+
+func (p *Protocol) setReachability(state ReachabilityState) {
+	if p.properties == nil {
 		return
 	}
 
-	oldState := oldVariant.Value().(ReachabilityState)
+	p.Lock()
+	oldState := p.Reachability
 	if oldState == state {
+		p.Unlock()
 		return
 	}
+	p.Reachability = state
+	p.Unlock()
 
 	p.log.Info("propertyReachabilityState of the protocol", p.protocolName, "changed from", oldState, "to", state)
 	p.properties.SetMust(dbusProtocolInterface, propertyReachabilityState, state)
@@ -0,0 +1,102 @@
+package dbusconn
+
+import (
+	"time"
+)
+
+const (
+	propertyLastUpdated          = "LastUpdated"
+	propertyLastUpdatedMonotonic = "LastUpdatedMonotonic"
+	propertyQuality              = "Quality"
+
+	// staleFactor number of periods without value before a polled item becomes stale
+	staleFactor = 3
+
+	// QualityGood state 'good' for Quality, the value has just been read
+	QualityGood Quality = "GOOD"
+	// QualityStale state 'stale' for Quality, the value has not been refreshed in time
+	QualityStale Quality = "STALE"
+	// QualityUncertain state 'uncertain' for Quality, the value is estimated or restored from a cache
+	QualityUncertain Quality = "UNCERTAIN"
+	// QualityBad state 'bad' for Quality, the value is known to be wrong
+	QualityBad Quality = "BAD"
+)
+
+// Quality informs if the value of an item can be trusted
+type Quality string
+
+// monotonicOrigin origin of the LastUpdatedMonotonic property
+var monotonicOrigin = time.Now()
+
+// LastUpdated returns when the value of the item was last published
+func (i *Item) LastUpdated() time.Time {
+	i.Lock()
+	defer i.Unlock()
+	return i.lastUpdated
+}
+
+// Quality returns the quality of the current value of the item
+func (i *Item) Quality() Quality {
+	i.Lock()
+	defer i.Unlock()
+	return i.quality
+}
+
+// SetQuality set the value of the property Quality
+func (i *Item) SetQuality(quality Quality) {
+	i.Lock()
+	oldQuality := i.quality
+	i.quality = quality
+	i.Unlock()
+
+	if i.properties == nil || oldQuality == quality {
+		return
+	}
+
+	i.log.Info("Quality of the item", i.ItemID, "changed from", oldQuality, "to", quality)
+	i.properties.SetMust(dbusItemInterface, propertyQuality, quality)
+}
+
+// valueUpdated records the time of a new value, sets its quality and re-arms the staleness timer
+func (i *Item) valueUpdated(quality Quality) time.Time {
+	now := time.Now()
+	i.Lock()
+	i.lastUpdated = now
+	if period := i.stalePeriod(); period != 0 {
+		if i.staleTimer == nil {
+			i.staleTimer = time.AfterFunc(period, i.staleTimeout)
+		} else {
+			i.staleTimer.Reset(period)
+		}
+	}
+	i.Unlock()
+
+	if i.properties != nil {
+		i.properties.SetMust(dbusItemInterface, propertyLastUpdated, now.UnixNano()/int64(time.Millisecond))
+		i.properties.SetMust(dbusItemInterface, propertyLastUpdatedMonotonic, uint64(now.Sub(monotonicOrigin)/time.Millisecond))
+	}
+	i.SetQuality(quality)
+	return now
+}
+
+// stalePeriod returns the time after which the value is stale, 0 if the item is not polled
+func (i *Item) stalePeriod() time.Duration {
+	if i.Driver == nil || i.Driver.Frequency == nil || *i.Driver.Frequency <= 0 {
+		return 0
+	}
+	return staleFactor * time.Duration(*i.Driver.Frequency) * time.Second
+}
+
+func (i *Item) staleTimeout() {
+	if i.Quality() == QualityGood {
+		i.SetQuality(QualityStale)
+	}
+}
+
+func (i *Item) stopStaleTimer() {
+	i.Lock()
+	if i.staleTimer != nil {
+		i.staleTimer.Stop()
+	}
+	i.Unlock()
+}
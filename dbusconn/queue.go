@@ -0,0 +1,234 @@
+package dbusconn
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Sender is implemented by the protocol apps which send the targets through the command queue of the devices
+type Sender interface {
+	Send(context.Context, *Command) error
+}
+
+// Command is a target written on an item, waiting to be sent by the protocol app
+type Command struct {
+	Item     *Item
+	TargetID uint64
+	// Target bytes of the target, as stored in Item.Target
+	Target []byte
+	// Value target translated by the item driver, or decoded when the item has no driver
+	Value interface{}
+	// Attempt number of the current attempt, starting at 1
+	Attempt int
+}
+
+// RetryPolicy tells how the commands of a device are sent and retried
+type RetryPolicy struct {
+	// MaxAttempts number of attempts before the target fails, 0 means 1
+	MaxAttempts int
+	// InitialBackoff wait before the first retry
+	InitialBackoff time.Duration
+	// MaxBackoff maximum wait between two retries
+	MaxBackoff time.Duration
+	// Multiplier factor applied to the backoff after each retry
+	Multiplier float64
+	// MinInterval minimum time between two commands sent to the device
+	MinInterval time.Duration
+}
+
+// QueueStats metrics of the command queue of a device
+type QueueStats struct {
+	Depth     int
+	Enqueued  uint64
+	Coalesced uint64
+	Sent      uint64
+	Retried   uint64
+	Failed    uint64
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     5 * time.Second,
+	Multiplier:     2,
+}
+
+type commandQueue struct {
+	sync.Mutex
+
+	device   *Device
+	pending  []*Command
+	stats    QueueStats
+	notify   chan struct{}
+	ctx      context.Context
+	cancel   context.CancelFunc
+	lastSend time.Time
+}
+
+// enqueue adds a command at the end of the queue of the device
+// A command waiting for the same item is replaced, keeping its place in the queue
+func (d *Device) enqueue(cmd *Command) {
+	d.Lock()
+	if d.queue == nil {
+		ctx, cancel := context.WithCancel(d.dc.context())
+		d.queue = &commandQueue{device: d, notify: make(chan struct{}, 1), ctx: ctx, cancel: cancel}
+		go d.queue.run()
+	}
+	q := d.queue
+	d.Unlock()
+
+	q.Lock()
+	q.stats.Enqueued++
+	coalesced := false
+	for idx, pending := range q.pending {
+		if pending.Item == cmd.Item {
+			q.pending[idx] = cmd
+			q.stats.Coalesced++
+			coalesced = true
+			break
+		}
+	}
+	if !coalesced {
+		q.pending = append(q.pending, cmd)
+	}
+	q.Unlock()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// QueueStats returns the metrics of the command queue of the device
+func (d *Device) QueueStats() QueueStats {
+	d.Lock()
+	q := d.queue
+	d.Unlock()
+
+	if q == nil {
+		return QueueStats{}
+	}
+
+	q.Lock()
+	defer q.Unlock()
+	stats := q.stats
+	stats.Depth = len(q.pending)
+	return stats
+}
+
+func (d *Device) stopQueue() {
+	d.Lock()
+	if d.queue != nil {
+		d.queue.cancel()
+	}
+	d.Unlock()
+}
+
+func (q *commandQueue) run() {
+	for {
+		cmd := q.next()
+		if cmd == nil {
+			return
+		}
+		q.send(cmd)
+	}
+}
+
+// next waits for the first command of the queue, it returns nil when the queue is stopped
+func (q *commandQueue) next() *Command {
+	for {
+		q.Lock()
+		if len(q.pending) > 0 {
+			cmd := q.pending[0]
+			q.pending = q.pending[1:]
+			q.Unlock()
+			return cmd
+		}
+		q.Unlock()
+
+		select {
+		case <-q.notify:
+		case <-q.ctx.Done():
+			return nil
+		}
+	}
+}
+
+// superseded tells if a newer command for the same item is waiting
+func (q *commandQueue) superseded(cmd *Command) bool {
+	q.Lock()
+	defer q.Unlock()
+	for _, pending := range q.pending {
+		if pending.Item == cmd.Item {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *commandQueue) send(cmd *Command) {
+	policy := q.device.Protocol.CommandRetry
+	backoff := policy.InitialBackoff
+
+	for cmd.Attempt = 1; ; cmd.Attempt++ {
+		if wait := policy.MinInterval - time.Since(q.lastSend); wait > 0 && !q.sleep(wait) {
+			return
+		}
+		q.lastSend = time.Now()
+
+		err := q.device.sendCB.Send(q.ctx, cmd)
+		if err == nil {
+			q.Lock()
+			q.stats.Sent++
+			q.Unlock()
+			if cmd.Item.confirmsState() {
+				// The target is acknowledged by the next value of the item
+				cmd.Item.targetSent()
+			} else {
+				cmd.Item.AckTarget(cmd.TargetID)
+			}
+			return
+		}
+
+		if q.ctx.Err() != nil {
+			return
+		}
+
+		if cmd.Attempt >= policy.MaxAttempts || q.superseded(cmd) {
+			q.Lock()
+			q.stats.Failed++
+			q.Unlock()
+			cmd.Item.log.Warning("Command for the item", cmd.Item.ItemID, "failed after", cmd.Attempt, "attempts:", err)
+			cmd.Item.FailTarget(cmd.TargetID, err.Error())
+			return
+		}
+
+		q.Lock()
+		q.stats.Retried++
+		q.Unlock()
+		cmd.Item.log.Info("Command for the item", cmd.Item.ItemID, "failed, retry in", backoff, ":", err)
+		if !q.sleep(backoff) {
+			return
+		}
+
+		if policy.Multiplier > 1 {
+			backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		}
+		if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+			backoff = policy.MaxBackoff
+		}
+	}
+}
+
+// sleep waits for d, it returns false if the queue is stopped meanwhile
+func (q *commandQueue) sleep(d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-q.ctx.Done():
+		return false
+	}
+}
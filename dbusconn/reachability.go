@@ -0,0 +1,54 @@
+package dbusconn
+
+const (
+	// ReachabilityManual the ReachabilityState is only set by the protocol app
+	ReachabilityManual ReachabilityRule = iota
+	// ReachabilityAnyDevice the protocol is OK when at least one device is operable, KO when all of them are KO
+	ReachabilityAnyDevice
+	// ReachabilityAllDevices the protocol is KO as soon as one device is KO, OK when all of them are operable
+	ReachabilityAllDevices
+)
+
+// ReachabilityRule tells how the ReachabilityState of a protocol is derived from its devices
+type ReachabilityRule int
+
+// ClearReachabilityOverride lets the ReachabilityRule drive the ReachabilityState again
+func (p *Protocol) ClearReachabilityOverride() {
+	p.Lock()
+	p.reachabilityOverridden = false
+	p.Unlock()
+
+	p.updateReachability()
+}
+
+// updateReachability derives the ReachabilityState from the OperabilityState of the devices
+// Devices in an unknown state are ignored, the state is left untouched when no device state is known
+// The rule does not apply while the state is overridden or set by the monitor
+func (p *Protocol) updateReachability() {
+	p.Lock()
+	if p.ReachabilityRule == ReachabilityManual || p.reachabilityOverridden || p.stopMonitor != nil {
+		p.Unlock()
+		return
+	}
+	rule := p.ReachabilityRule
+	var operable, ko int
+	for _, d := range p.Devices {
+		switch d.GetOperability() {
+		case OperabilityOk, OperabilityPartial:
+			operable++
+		case OperabilityKo:
+			ko++
+		}
+	}
+	p.Unlock()
+
+	if operable+ko == 0 {
+		return
+	}
+
+	state := ReachabilityOk
+	if (rule == ReachabilityAnyDevice && operable == 0) || (rule == ReachabilityAllDevices && ko > 0) {
+		state = ReachabilityKo
+	}
+	p.setReachability(state)
+}
@@ -0,0 +1,81 @@
+package dbusconn
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+)
+
+const (
+	defaultResetDelay = time.Second
+)
+
+// resetValue returns the bytes and the dbus value of the rest value of the item, false if the item has no rest value
+func (i *Item) resetValue() ([]byte, interface{}, bool) {
+	if i.Driver == nil || i.Driver.HDesc == nil || i.Driver.HDesc.ResetValue == nil {
+		return nil, nil, false
+	}
+
+	dbusValue, err := i.coerce(*i.Driver.HDesc.ResetValue)
+	if err != nil {
+		i.log.Warning("Reset value of the item", i.ItemID, "not valid:", err)
+		return nil, nil, false
+	}
+	data, err := encodeValue(i.ValueKind, dbusValue)
+	if err != nil {
+		return nil, nil, false
+	}
+	return data, dbusValue, true
+}
+
+// resetDelay returns the time after which the value goes back to rest
+// The resetDelay key (ms) of the item options takes precedence over the one of the descriptor
+func (i *Item) resetDelay() time.Duration {
+	options := i.GetOptions()
+
+	var itemOptions struct {
+		ResetDelay *int `json:"resetDelay"`
+	}
+	if len(options) > 0 && json.Unmarshal(options, &itemOptions) == nil && itemOptions.ResetDelay != nil {
+		return time.Duration(*itemOptions.ResetDelay) * time.Millisecond
+	}
+
+	if hd := i.Driver.HDesc; hd.ResetDelay != nil {
+		return time.Duration(*hd.ResetDelay) * time.Millisecond
+	}
+	return defaultResetDelay
+}
+
+// armReset restarts the reset timer after each value which is not the rest value
+func (i *Item) armReset(data []byte) {
+	resetData, resetDbusValue, ok := i.resetValue()
+	if !ok {
+		return
+	}
+
+	delay := i.resetDelay()
+
+	// The timer is replaced in one critical section, a concurrent value can not leave a timer running
+	i.Lock()
+	defer i.Unlock()
+	if i.resetTimer != nil {
+		i.resetTimer.Stop()
+		i.resetTimer = nil
+	}
+	if bytes.Equal(data, resetData) {
+		return
+	}
+	i.resetTimer = time.AfterFunc(delay, func() {
+		i.log.Info("Value of the item", i.ItemID, "goes back to rest")
+		// The rest value is not a reading, the quality, the history and the operability are left untouched
+		i.publishValue(resetData, resetDbusValue)
+	})
+}
+
+func (i *Item) stopResetTimer() {
+	i.Lock()
+	if i.resetTimer != nil {
+		i.resetTimer.Stop()
+	}
+	i.Unlock()
+}
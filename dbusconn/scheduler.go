@@ -0,0 +1,81 @@
+package dbusconn
+
+import (
+	"context"
+	"math/rand"
+	"time"
+)
+
+const (
+	// maxPollBackoff maximum factor applied to the polling period of an item whose device is KO
+	maxPollBackoff = 8
+)
+
+// startPolling starts to poll the item at the frequency of its driver, if the protocol app implements PollItem
+func (i *Item) startPolling() {
+	if isNil(i.pollItemCB) || i.Driver == nil || i.Driver.Frequency == nil || *i.Driver.Frequency <= 0 {
+		return
+	}
+
+	period := time.Duration(*i.Driver.Frequency) * time.Second
+	ctx, cancel := context.WithCancel(i.dc.context())
+
+	i.Lock()
+	if i.stopPoll != nil {
+		i.stopPoll()
+	}
+	i.stopPoll = cancel
+	i.Unlock()
+
+	go i.poll(ctx, period, i.pollFrame())
+}
+
+func (i *Item) stopPolling() {
+	i.Lock()
+	if i.stopPoll != nil {
+		i.stopPoll()
+		i.stopPoll = nil
+	}
+	i.Unlock()
+}
+
+// pollFrame returns the frame to send to read the item
+func (i *Item) pollFrame() string {
+	if hd := i.Driver.HDesc; hd != nil {
+		if hd.RequestFrame != nil {
+			return *hd.RequestFrame
+		}
+		if hd.StateRequestFrame != nil {
+			return *hd.StateRequestFrame
+		}
+	}
+	return i.Driver.Read.Field
+}
+
+func (i *Item) poll(ctx context.Context, period time.Duration, frame string) {
+	// Spread the first polls of the items to avoid bursts
+	delay := time.Duration(rand.Int63n(int64(period)))
+	backoff := 1
+
+	for {
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if i.Device.GetOperability() == OperabilityKo {
+			// Keep polling the device to detect when it comes back, but less often
+			if backoff < maxPollBackoff {
+				backoff *= 2
+			}
+		} else {
+			backoff = 1
+		}
+
+		i.pollItemCB.PollItem(i, frame)
+		delay = period * time.Duration(backoff)
+	}
+}
@@ -0,0 +1,281 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	snapshotDir = "/data/opencaps/pif/"
+
+	// snapshotDelay time during which the changes are gathered before the snapshot is written
+	snapshotDelay = 2 * time.Second
+	// valueSnapshotDelay time during which the changes of values are gathered, to spare the flash
+	valueSnapshotDelay = time.Minute
+)
+
+// snapshot is the local copy of the bridges, devices and items of the protocol
+// It is used when the DeviceManager can not be reached at startup
+type snapshot struct {
+	Bridges []string         `json:"bridges"`
+	Devices []snapshotDevice `json:"devices"`
+}
+
+type snapshotDevice struct {
+	BridgeID    string          `json:"bridgeID,omitempty"`
+	DevID       string          `json:"devID"`
+	ComID       string          `json:"comID"`
+	TypeID      string          `json:"typeID"`
+	TypeVersion string          `json:"typeVersion"`
+	Options     json.RawMessage `json:"options,omitempty"`
+	Items       []snapshotItem  `json:"items"`
+}
+
+type snapshotItem struct {
+	ItemID      string          `json:"itemID"`
+	TypeID      string          `json:"typeID"`
+	TypeVersion string          `json:"typeVersion"`
+	Options     json.RawMessage `json:"options,omitempty"`
+	Value       []byte          `json:"value,omitempty"`
+}
+
+// snapshotChanged schedules the writing of the snapshot after a change of the devices or items
+func (dc *Dbus) snapshotChanged() {
+	dc.scheduleSnapshot(snapshotDelay)
+}
+
+// snapshotValueChanged schedules the writing of the snapshot after a change of value
+// The values change too often to rewrite the snapshot each time, they are gathered for longer
+func (dc *Dbus) snapshotValueChanged() {
+	dc.scheduleSnapshot(valueSnapshotDelay)
+}
+
+// scheduleSnapshot writes the snapshot after delay, unless it is already scheduled earlier
+func (dc *Dbus) scheduleSnapshot(delay time.Duration) {
+	if dc.DisableSnapshot {
+		return
+	}
+
+	dc.snapshotMu.Lock()
+	defer dc.snapshotMu.Unlock()
+
+	due := time.Now().Add(delay)
+	if dc.snapshotTimer != nil {
+		if !due.Before(dc.snapshotDue) {
+			return
+		}
+		dc.snapshotTimer.Stop()
+	}
+
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		dc.snapshotMu.Lock()
+		if dc.snapshotTimer == timer {
+			dc.snapshotTimer = nil
+		}
+		dc.snapshotMu.Unlock()
+		dc.writeSnapshot()
+	})
+	dc.snapshotTimer = timer
+	dc.snapshotDue = due
+}
+
+// flushSnapshot writes the pending changes immediately
+func (dc *Dbus) flushSnapshot() {
+	dc.snapshotMu.Lock()
+	timer := dc.snapshotTimer
+	dc.snapshotTimer = nil
+	dc.snapshotMu.Unlock()
+
+	if timer != nil && timer.Stop() {
+		dc.writeSnapshot()
+	}
+}
+
+// writeSnapshot replaces the snapshot file, the file is either the previous or the new snapshot
+func (dc *Dbus) writeSnapshot() {
+	data, err := json.Marshal(dc.buildSnapshot())
+	if err != nil {
+		dc.Log.Error("Fail to serialize the snapshot:", err)
+		return
+	}
+
+	dir := filepath.Dir(dc.SnapshotPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		dc.Log.Error("Fail to create the snapshot dir:", err)
+		return
+	}
+
+	tmp, err := os.CreateTemp(dir, ".snapshot-*")
+	if err != nil {
+		dc.Log.Error("Fail to write the snapshot:", err)
+		return
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dc.SnapshotPath)
+	}
+	if err != nil {
+		dc.Log.Error("Fail to write the snapshot:", err)
+	}
+}
+
+func (dc *Dbus) buildSnapshot() snapshot {
+	snap := snapshot{Bridges: []string{}, Devices: []snapshotDevice{}}
+
+	for bridgeID, p := range dc.protocols() {
+		if bridgeID != "" {
+			snap.Bridges = append(snap.Bridges, bridgeID)
+		}
+
+		for _, d := range p.devices() {
+			d.Lock()
+			dev := snapshotDevice{
+				BridgeID:    bridgeID,
+				DevID:       d.DevID,
+				ComID:       d.Address,
+				TypeID:      d.TypeID,
+				TypeVersion: d.TypeVersion,
+				Options:     rawOptions(d.Options),
+				Items:       []snapshotItem{},
+			}
+			items := make([]*Item, 0, len(d.Items))
+			for _, i := range d.Items {
+				items = append(items, i)
+			}
+			d.Unlock()
+
+			for _, i := range items {
+				dev.Items = append(dev.Items, snapshotItem{
+					ItemID:      i.ItemID,
+					TypeID:      i.TypeID,
+					TypeVersion: i.TypeVersion,
+					Options:     rawOptions(i.GetOptions()),
+					Value:       i.GetValue(),
+				})
+			}
+			snap.Devices = append(snap.Devices, dev)
+		}
+	}
+	return snap
+}
+
+// rawOptions keeps the options readable in the snapshot, options which are not JSON are left out
+func rawOptions(options []byte) json.RawMessage {
+	if len(options) == 0 || !json.Valid(options) {
+		return nil
+	}
+	return json.RawMessage(options)
+}
+
+// loadSnapshot reads the snapshot file, nil is returned when there is none
+func (dc *Dbus) loadSnapshot() *snapshot {
+	if dc.DisableSnapshot {
+		return nil
+	}
+
+	data, err := os.ReadFile(dc.SnapshotPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		dc.Log.Warning("Unable to read the snapshot:", err)
+		return nil
+	}
+
+	snap := &snapshot{}
+	if err := json.Unmarshal(data, snap); err != nil {
+		dc.Log.Error("Could not read the snapshot:", err)
+		return nil
+	}
+	return snap
+}
+
+// applySnapshot restores the bridges, devices, items and values of the snapshot
+func (dc *Dbus) applySnapshot(snap *snapshot) {
+	dc.Log.Info("Restore", len(snap.Devices), "devices from the snapshot")
+	for _, bridgeID := range snap.Bridges {
+		dc.RootProtocol.AddBridge(bridgeID)
+	}
+
+	for _, dev := range snap.Devices {
+		if dev.BridgeID != "" {
+			dc.RootProtocol.AddBridge(dev.BridgeID)
+		}
+		p := dc.protocols()[dev.BridgeID]
+
+		device := DeviceJson{
+			DevID:          dev.DevID,
+			ComID:          dev.ComID,
+			DevTypeID:      dev.TypeID,
+			DevTypeVersion: dev.TypeVersion,
+			DevOptions:     json.RawMessage(dev.Options),
+		}
+		for _, item := range dev.Items {
+			device.Items = append(device.Items, ItemJson{
+				ItemID:          item.ItemID,
+				ItemTypeID:      item.TypeID,
+				ItemTypeVersion: item.TypeVersion,
+				ItemOptions:     json.RawMessage(item.Options),
+			})
+		}
+		dc.restoreDevice(p, device, false)
+	}
+
+	dc.restoreValues(snap)
+}
+
+// restoreValues gives their last known value to the items which have none
+func (dc *Dbus) restoreValues(snap *snapshot) {
+	protocols := dc.protocols()
+	for _, dev := range snap.Devices {
+		p, ok := protocols[dev.BridgeID]
+		if !ok {
+			continue
+		}
+		d, ok := p.device(dev.DevID)
+		if !ok {
+			continue
+		}
+
+		for _, item := range dev.Items {
+			d.Lock()
+			i, ok := d.Items[item.ItemID]
+			d.Unlock()
+			if ok && item.Value != nil {
+				i.restoreValue(item.Value)
+			}
+		}
+	}
+}
+
+// restoreValue sets the value of the item without considering it as a new reading
+// The quality of the item is left uncertain and the history is not updated
+func (i *Item) restoreValue(data []byte) {
+	if _, err := i.decodeValue(data); err != nil {
+		return
+	}
+
+	i.publishMu.Lock()
+	defer i.publishMu.Unlock()
+	i.Lock()
+	if i.Value != nil {
+		i.Unlock()
+		return
+	}
+	i.Value = data
+	i.Unlock()
+
+	if i.properties != nil {
+		i.properties.SetMust(dbusItemInterface, propertyValue, i.exportedValue(data))
+	}
+}
@@ -0,0 +1,194 @@
+package dbusconn
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// fakeDeviceManager answers the calls of the protocol to the DeviceManager
+type fakeDeviceManager struct {
+	bridges   BridgeJson
+	protocols ProtocolJson
+}
+
+func (dm *fakeDeviceManager) GetBridges() (string, *dbus.Error) {
+	data, _ := json.Marshal(dm.bridges)
+	return string(data), nil
+}
+
+func (dm *fakeDeviceManager) GetStoredDevices(protocol string) (string, *dbus.Error) {
+	data, _ := json.Marshal(dm.protocols)
+	return string(data), nil
+}
+
+func startDeviceManager(t *testing.T, address string, dm *fakeDeviceManager) {
+	conn := connectTestBus(t, address)
+	t.Cleanup(func() { conn.Close() })
+	if err := conn.Export(dm, deviceManagerPath, deviceManagerDestination); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.RequestName(deviceManagerDestination, dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testItem(t *testing.T, p *Protocol, devID string, itemID string) *Item {
+	t.Helper()
+	d, ok := p.device(devID)
+	if !ok {
+		t.Fatalf("Device %s missing", devID)
+	}
+	d.Lock()
+	defer d.Unlock()
+	i, ok := d.Items[itemID]
+	if !ok {
+		t.Fatalf("Item %s of the device %s missing", itemID, devID)
+	}
+	return i
+}
+
+// writeTestSnapshot saves a root device with one item and a bridge with one device
+func writeTestSnapshot(t *testing.T, address string, path string) {
+	dc := newTestDbus(t, address, path)
+	root := dc.RootProtocol.Protocol
+	root.AddDevice("dev1", "com1", "devType", "1.0.0", []byte(`{"channel":11}`))
+	d, _ := root.device("dev1")
+	d.AddItem("item1", "itemType", "1.0.0", []byte(`{"unit":"C"}`))
+	testItem(t, root, "dev1", "item1").SetValue([]byte("21.5"))
+
+	dc.RootProtocol.AddBridge("b1")
+	dc.protocols()["b1"].AddDevice("dev2", "com2", "devType", "1.0.0", nil)
+	dc.Close()
+}
+
+func TestSnapshotWriteAndRestore(t *testing.T) {
+	address := startTestBus(t)
+	path := filepath.Join(t.TempDir(), "test.json")
+	writeTestSnapshot(t, address, path)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal("Snapshot not written:", err)
+	}
+	if !bytes.Contains(data, []byte(`"options":{"channel":11}`)) || !bytes.Contains(data, []byte(`"options":{"unit":"C"}`)) {
+		t.Errorf("Options not saved as JSON: %s", data)
+	}
+
+	// The DeviceManager is not on the bus, the devices come from the snapshot
+	dc := newTestDbus(t, address, path)
+	dc.restore()
+
+	root := dc.RootProtocol.Protocol
+	d, ok := root.device("dev1")
+	if !ok {
+		t.Fatal("Device not restored")
+	}
+	if got := string(d.GetOptions()); got != `{"channel":11}` {
+		t.Errorf("Device options restored as %s", got)
+	}
+	i := testItem(t, root, "dev1", "item1")
+	if got := string(i.GetOptions()); got != `{"unit":"C"}` {
+		t.Errorf("Item options restored as %s", got)
+	}
+	if got := string(i.GetValue()); got != "21.5" {
+		t.Errorf("Item value restored as %s", got)
+	}
+	if i.Quality() == QualityGood {
+		t.Error("Restored value considered as a reading")
+	}
+	bridge, ok := dc.protocols()["b1"]
+	if !ok {
+		t.Fatal("Bridge not restored")
+	}
+	if _, ok := bridge.device("dev2"); !ok {
+		t.Error("Device of the bridge not restored")
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	address := startTestBus(t)
+	path := filepath.Join(t.TempDir(), "test.json")
+	writeTestSnapshot(t, address, path)
+
+	dc := newTestDbus(t, address, path)
+	dc.restore()
+	dc.reconcile(
+		BridgeJson{Bridges: map[string]string{"b2": "test", "other": "otherProtocol"}},
+		ProtocolJson{Protocols: map[string][]DeviceJson{
+			"test": {{
+				DevID: "dev1", ComID: "com1", DevTypeID: "devType", DevTypeVersion: "1.0.0",
+				DevOptions: json.RawMessage(`{"channel":15}`),
+				Items: []ItemJson{
+					{ItemID: "item2", ItemTypeID: "itemType", ItemTypeVersion: "1.0.0"},
+				},
+			}},
+			"test_b2": {{DevID: "dev3", ComID: "com3", DevTypeID: "devType", DevTypeVersion: "1.0.0"}},
+		}},
+	)
+
+	protocols := dc.protocols()
+	if _, ok := protocols["b1"]; ok {
+		t.Error("Bridge unknown to the DeviceManager kept")
+	}
+	if _, ok := protocols["other"]; ok {
+		t.Error("Bridge of another protocol added")
+	}
+	root := protocols[""]
+	d, ok := root.device("dev1")
+	if !ok {
+		t.Fatal("Device listed by the DeviceManager removed")
+	}
+	if got := string(d.GetOptions()); got != `{"channel":15}` {
+		t.Errorf("Device options are %s, expected the ones of the DeviceManager", got)
+	}
+	d.Lock()
+	_, kept := d.Items["item1"]
+	_, added := d.Items["item2"]
+	d.Unlock()
+	if kept || !added {
+		t.Errorf("Items not reconciled: item1 kept %v, item2 added %v", kept, added)
+	}
+	bridge, ok := protocols["b2"]
+	if !ok {
+		t.Fatal("Bridge of the DeviceManager not added")
+	}
+	if _, ok := bridge.device("dev3"); !ok {
+		t.Error("Device of the bridge not added")
+	}
+}
+
+func TestRetryDeviceManager(t *testing.T) {
+	oldInitial, oldMax := deviceManagerRetryInitial, deviceManagerRetryMax
+	deviceManagerRetryInitial, deviceManagerRetryMax = 10*time.Millisecond, 40*time.Millisecond
+	t.Cleanup(func() {
+		deviceManagerRetryInitial, deviceManagerRetryMax = oldInitial, oldMax
+	})
+
+	address := startTestBus(t)
+	dc := newTestDbus(t, address, filepath.Join(t.TempDir(), "test.json"))
+	dc.restore()
+	if devices := dc.RootProtocol.Protocol.devices(); len(devices) != 0 {
+		t.Fatalf("%d devices without DeviceManager nor snapshot", len(devices))
+	}
+
+	// The DeviceManager comes up after a few retries
+	time.Sleep(100 * time.Millisecond)
+	startDeviceManager(t, address, &fakeDeviceManager{
+		protocols: ProtocolJson{Protocols: map[string][]DeviceJson{
+			"test": {{DevID: "dev1", ComID: "com1", DevTypeID: "devType", DevTypeVersion: "1.0.0"}},
+		}},
+	})
+
+	for start := time.Now(); time.Since(start) < 5*time.Second; time.Sleep(10 * time.Millisecond) {
+		if _, ok := dc.RootProtocol.Protocol.device("dev1"); ok {
+			return
+		}
+	}
+	t.Error("Devices not reconciled once the DeviceManager answers")
+}
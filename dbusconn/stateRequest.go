@@ -0,0 +1,76 @@
+package dbusconn
+
+import (
+	"time"
+)
+
+// confirmsState tells if the state of the item is reported after a target write,
+// either by the device itself or by a state request
+func (i *Item) confirmsState() bool {
+	if i.Driver == nil || i.Driver.HDesc == nil {
+		return false
+	}
+	hd := i.Driver.HDesc
+	return (hd.AutoStateResponse != nil && *hd.AutoStateResponse) || i.needsStateRequest()
+}
+
+// needsStateRequest tells if pif has to request the state of the item after a target write
+func (i *Item) needsStateRequest() bool {
+	if isNil(i.requestStateCB) || i.Driver == nil || i.Driver.HDesc == nil {
+		return false
+	}
+	hd := i.Driver.HDesc
+	return hd.StateRequestFrame != nil && (hd.AutoStateResponse == nil || !*hd.AutoStateResponse)
+}
+
+// targetSent is called once a target has been sent to the device
+// The next value of the item acknowledges the target, and the state is requested if the device does not report it
+func (i *Item) targetSent() {
+	if !i.confirmsState() {
+		return
+	}
+
+	i.Lock()
+	i.awaitingState = true
+	if i.stateTimer != nil {
+		i.stateTimer.Stop()
+		i.stateTimer = nil
+	}
+	if i.needsStateRequest() {
+		var delay time.Duration
+		if i.Driver.HDesc.StateRequestDelay != nil {
+			delay = time.Duration(*i.Driver.HDesc.StateRequestDelay) * time.Millisecond
+		}
+		frame := *i.Driver.HDesc.StateRequestFrame
+		i.stateTimer = time.AfterFunc(delay, func() {
+			i.log.Info("Request the state of the item", i.ItemID)
+			i.requestStateCB.RequestState(i, frame)
+		})
+	}
+	i.Unlock()
+}
+
+// stateReceived is called for each value of the item, it acknowledges the target waiting for the state
+func (i *Item) stateReceived() {
+	i.Lock()
+	if i.stateTimer != nil {
+		i.stateTimer.Stop()
+		i.stateTimer = nil
+	}
+	awaiting := i.awaitingState
+	i.awaitingState = false
+	id := i.targetID
+	i.Unlock()
+
+	if awaiting {
+		i.AckTarget(id)
+	}
+}
+
+func (i *Item) stopStateTimer() {
+	i.Lock()
+	if i.stateTimer != nil {
+		i.stateTimer.Stop()
+	}
+	i.Unlock()
+}
@@ -0,0 +1,139 @@
+package dbusconn
+
+import (
+	"time"
+)
+
+const (
+	propertyTargetState = "TargetState"
+	propertyTargetID    = "TargetID"
+
+	signalTargetResult = "TargetResult"
+
+	defaultTargetTimeout = 10 * time.Second
+
+	// TargetIdle state 'idle' for TargetState, no target has been written yet
+	TargetIdle TargetState = "IDLE"
+	// TargetPending state 'pending' for TargetState, the target waits for its acknowledgement
+	TargetPending TargetState = "PENDING"
+	// TargetAcked state 'acked' for TargetState, the target has been applied
+	TargetAcked TargetState = "ACKED"
+	// TargetFailed state 'failed' for TargetState, the protocol app failed to apply the target
+	TargetFailed TargetState = "FAILED"
+	// TargetTimeout state 'timeout' for TargetState, the target has not been acknowledged in time
+	TargetTimeout TargetState = "TIMEOUT"
+)
+
+// TargetState informs about the last target written on an item
+type TargetState string
+
+// TargetWriter is implemented by the protocol apps which report the result of each target
+// with AckTarget or FailTarget, id identifies the target
+type TargetWriter interface {
+	SetItemTargetWithID(i *Item, id uint64, target []byte)
+}
+
+// TranslatedTargetWriter is the TargetWriter receiving the target translated by the item driver
+type TranslatedTargetWriter interface {
+	SetItemTranslatedTargetWithID(i *Item, id uint64, value interface{})
+}
+
+// CurrentTargetID returns the ID of the last target written on the item
+func (i *Item) CurrentTargetID() uint64 {
+	i.Lock()
+	defer i.Unlock()
+	return i.targetID
+}
+
+// TargetState returns the state of the last target written on the item
+func (i *Item) TargetState() TargetState {
+	i.Lock()
+	defer i.Unlock()
+	return i.targetState
+}
+
+// AckTarget marks the target id as applied, it returns false if the target is not pending anymore
+func (i *Item) AckTarget(id uint64) bool {
+	return i.endTarget(id, TargetAcked, "")
+}
+
+// FailTarget marks the target id as failed, it returns false if the target is not pending anymore
+func (i *Item) FailTarget(id uint64, reason string) bool {
+	return i.endTarget(id, TargetFailed, reason)
+}
+
+// startTarget opens a new target transaction, the properties are published by publishTargetState
+func (i *Item) startTarget() uint64 {
+	timeout := i.targetTimeout()
+
+	i.Lock()
+	i.targetID++
+	id := i.targetID
+	i.targetState = TargetPending
+	if i.targetTimer != nil {
+		i.targetTimer.Stop()
+	}
+	i.targetTimer = time.AfterFunc(timeout, func() {
+		i.endTarget(id, TargetTimeout, "not acknowledged after "+timeout.String())
+	})
+	i.Unlock()
+
+	i.log.Info("Target", id, "of the item", i.ItemID, "pending")
+	return id
+}
+
+func (i *Item) endTarget(id uint64, state TargetState, reason string) bool {
+	i.Lock()
+	if id != i.targetID || i.targetState != TargetPending {
+		i.Unlock()
+		return false
+	}
+	i.targetState = state
+	if i.targetTimer != nil {
+		i.targetTimer.Stop()
+	}
+	i.Unlock()
+
+	i.log.Info("Target", id, "of the item", i.ItemID, "ended with", state, reason)
+	i.publishTargetState()
+	i.EmitDbusSignal(signalTargetResult, id, string(state), reason)
+	return true
+}
+
+// publishTargetState publishes the current target, the state is read under publishMu
+// so that a late call can not publish a state older than the one already published
+func (i *Item) publishTargetState() {
+	if i.properties == nil {
+		return
+	}
+
+	i.publishMu.Lock()
+	defer i.publishMu.Unlock()
+	i.Lock()
+	id, state := i.targetID, i.targetState
+	i.Unlock()
+
+	i.properties.SetMust(dbusItemInterface, propertyTargetID, id)
+	i.properties.SetMust(dbusItemInterface, propertyTargetState, state)
+}
+
+// targetTimeout returns the time given to acknowledge a target
+// The state request delay of the driver is added, the state is only known after it
+func (i *Item) targetTimeout() time.Duration {
+	timeout := i.Device.Protocol.TargetTimeout
+	if timeout <= 0 {
+		timeout = defaultTargetTimeout
+	}
+	if i.Driver != nil && i.Driver.HDesc != nil && i.Driver.HDesc.StateRequestDelay != nil {
+		timeout += time.Duration(*i.Driver.HDesc.StateRequestDelay) * time.Millisecond
+	}
+	return timeout
+}
+
+func (i *Item) stopTargetTimer() {
+	i.Lock()
+	if i.targetTimer != nil {
+		i.targetTimer.Stop()
+	}
+	i.Unlock()
+}
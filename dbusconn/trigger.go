@@ -0,0 +1,38 @@
+package dbusconn
+
+import (
+	"time"
+)
+
+const (
+	signalTriggered = "Triggered"
+
+	// TriggerSignalAndValue FireEvent emits the Triggered signal and sets the value of the item
+	TriggerSignalAndValue TriggerMode = iota
+	// TriggerSignalOnly FireEvent only emits the Triggered signal and refreshes LastUpdated, the value of the item is not updated
+	TriggerSignalOnly
+)
+
+// TriggerMode tells what FireEvent does besides emitting the Triggered signal
+type TriggerMode int
+
+// FireEvent emits the Triggered signal with a sequence number and a timestamp (unix time in ms)
+// Unlike SetValue, the signal is emitted for each event, even if the payload did not change
+func (i *Item) FireEvent(payload []byte) {
+	now := time.Now()
+	i.Lock()
+	i.eventSeq++
+	seq := i.eventSeq
+	mode := i.TriggerMode
+	i.Unlock()
+
+	i.log.Info("Event", seq, "of the item", i.ItemID, "triggered:", string(payload))
+	i.EmitDbusSignal(signalTriggered, seq, now.UnixNano()/int64(time.Millisecond), payload)
+
+	if mode == TriggerSignalAndValue {
+		i.SetValue(payload)
+	} else if i.properties != nil {
+		// The event is a reading even if Value is not published, it keeps the item and its device alive
+		i.Device.seen(i.valueUpdated(QualityGood))
+	}
+}
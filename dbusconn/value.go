@@ -0,0 +1,277 @@
+package dbusconn
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/opencaps/pif/driver"
+)
+
+const (
+	// ValueBytes legacy mode, Value and Target are exported as byte arrays
+	ValueBytes ValueKind = iota
+	// ValueBool Value and Target are exported as booleans
+	ValueBool
+	// ValueInt Value and Target are exported as int64
+	ValueInt
+	// ValueFloat Value and Target are exported as doubles
+	ValueFloat
+	// ValueString Value and Target are exported as strings
+	ValueString
+	// ValueEnum Value and Target are exported as strings restricted to Item.EnumValues
+	ValueEnum
+	// ValueJSON Value and Target are exported as strings containing a JSON document
+	ValueJSON
+)
+
+// ValueKind tells how the value and the target of an item are exported on dbus
+type ValueKind int
+
+func (k ValueKind) String() string {
+	switch k {
+	case ValueBytes:
+		return "bytes"
+	case ValueBool:
+		return "bool"
+	case ValueInt:
+		return "int"
+	case ValueFloat:
+		return "float"
+	case ValueString:
+		return "string"
+	case ValueEnum:
+		return "enum"
+	case ValueJSON:
+		return "json"
+	}
+	return "unknown"
+}
+
+// zero returns the dbus value exported before any value is set
+func (k ValueKind) zero() interface{} {
+	switch k {
+	case ValueBool:
+		return false
+	case ValueInt:
+		return int64(0)
+	case ValueFloat:
+		return float64(0)
+	case ValueString, ValueEnum:
+		return ""
+	case ValueJSON:
+		return "null"
+	}
+	return []byte{}
+}
+
+// coerce converts a go value into the dbus value of the item kind
+func (i *Item) coerce(value interface{}) (interface{}, error) {
+	if b, ok := value.([]byte); ok && i.ValueKind != ValueBytes && i.ValueKind != ValueJSON {
+		value = string(b)
+	}
+
+	switch i.ValueKind {
+	case ValueBytes:
+		if b, ok := value.([]byte); ok {
+			return b, nil
+		}
+		return encodeValue(ValueJSON, value)
+
+	case ValueBool:
+		switch v := value.(type) {
+		case bool:
+			return v, nil
+		case string:
+			return strconv.ParseBool(v)
+		}
+		if f, ok := toFloat(value); ok {
+			return f != 0, nil
+		}
+
+	case ValueInt:
+		switch v := value.(type) {
+		case bool:
+			if v {
+				return int64(1), nil
+			}
+			return int64(0), nil
+		case string:
+			f, err := strconv.ParseFloat(v, 64)
+			return int64(f), err
+		}
+		if f, ok := toFloat(value); ok {
+			return int64(f), nil
+		}
+
+	case ValueFloat:
+		if s, ok := value.(string); ok {
+			return strconv.ParseFloat(s, 64)
+		}
+		if f, ok := toFloat(value); ok {
+			return f, nil
+		}
+
+	case ValueString:
+		return fmt.Sprint(value), nil
+
+	case ValueEnum:
+		s := fmt.Sprint(value)
+		if len(i.EnumValues) == 0 {
+			return s, nil
+		}
+		for _, allowed := range i.EnumValues {
+			if s == allowed {
+				return s, nil
+			}
+		}
+		return nil, fmt.Errorf("%q is not one of %v", s, i.EnumValues)
+
+	case ValueJSON:
+		raw, ok := value.([]byte)
+		if !ok {
+			if s, isString := value.(string); isString {
+				raw = []byte(s)
+			}
+		}
+		if raw != nil && json.Valid(raw) {
+			return string(raw), nil
+		}
+		data, err := json.Marshal(value)
+		return string(data), err
+	}
+
+	return nil, fmt.Errorf("%v (%T) can not be converted to %v", value, value, i.ValueKind)
+}
+
+// encodeValue returns the bytes stored in Item.Value and Item.Target for a dbus value
+func encodeValue(kind ValueKind, value interface{}) ([]byte, error) {
+	switch v := value.(type) {
+	case []byte:
+		return v, nil
+	case string:
+		if kind != ValueBytes {
+			return []byte(v), nil
+		}
+	}
+	return json.Marshal(value)
+}
+
+// decodeValue converts the bytes of Item.Value or Item.Target into the dbus value of the item kind
+func (i *Item) decodeValue(data []byte) (interface{}, error) {
+	switch i.ValueKind {
+	case ValueBytes:
+		return data, nil
+	case ValueString, ValueEnum, ValueJSON:
+		return i.coerce(data)
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		value = driver.ParseValue(string(data))
+	}
+	return i.coerce(value)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case uint32:
+		return float64(v), true
+	case uint64:
+		return float64(v), true
+	}
+	return 0, false
+}
+
+// SetValueBool set the value of a boolean item
+func (i *Item) SetValueBool(value bool) {
+	i.setTypedValue(value)
+}
+
+// SetValueInt set the value of an integer item
+func (i *Item) SetValueInt(value int64) {
+	i.setTypedValue(value)
+}
+
+// SetValueFloat set the value of a float item
+func (i *Item) SetValueFloat(value float64) {
+	i.setTypedValue(value)
+}
+
+// SetValueString set the value of a string item
+func (i *Item) SetValueString(value string) {
+	i.setTypedValue(value)
+}
+
+// SetValueEnum set the value of an enum item, the value must be one of Item.EnumValues
+func (i *Item) SetValueEnum(value string) {
+	i.setTypedValue(value)
+}
+
+// SetValueJSON set the value of a JSON item, value is marshalled unless it is already a JSON document
+func (i *Item) SetValueJSON(value interface{}) {
+	i.setTypedValue(value)
+}
+
+func (i *Item) setTypedValue(value interface{}) {
+	dbusValue, err := i.coerce(value)
+	if err != nil {
+		i.log.Warning("Value of the item", i.ItemID, "not valid:", err)
+		return
+	}
+	data, err := encodeValue(i.ValueKind, dbusValue)
+	if err != nil {
+		i.log.Warning("Fail to encode the value of the item", i.ItemID, err)
+		return
+	}
+	i.updateValue(data, dbusValue)
+}
+
+// updateValue set the property Value, data is the byte representation of the dbus value
+func (i *Item) updateValue(data []byte, dbusValue interface{}) {
+	if i.properties == nil {
+		return
+	}
+
+	// A reading refreshes the timestamps and the quality, even if the value did not change
+	now := i.valueUpdated(QualityGood)
+	i.Device.seen(now)
+	i.addHistory(HistoryEntry{Timestamp: now, Value: data, Quality: QualityGood, dbusValue: dbusValue})
+	defer i.stateReceived()
+	i.armReset(data)
+	i.publishValue(data, dbusValue)
+}
+
+// publishValue stores the value and updates the property Value when it changed
+// Unlike updateValue, it is not considered as a reading of the item
+func (i *Item) publishValue(data []byte, dbusValue interface{}) {
+	i.publishMu.Lock()
+	defer i.publishMu.Unlock()
+	i.Lock()
+	oldState := i.Value
+	if bytes.Equal(oldState, data) {
+		i.Unlock()
+		return
+	}
+	i.Value = data
+	i.Unlock()
+	i.dc.snapshotValueChanged()
+
+	i.log.Info("propertyValue of the item", i.ItemID, "changed from", string(oldState), "to", string(data))
+	if i.ValueKind == ValueBytes {
+		i.properties.SetMust(dbusItemInterface, propertyValue, data)
+	} else {
+		i.properties.SetMust(dbusItemInterface, propertyValue, dbusValue)
+	}
+}
@@ -0,0 +1,101 @@
+package dbusconn
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	propertyLastSeen = "LastSeen"
+
+	// watchdogFactor number of polling periods without value after which the device goes KO
+	watchdogFactor = 3
+)
+
+// LastSeen returns when a value of the device was last published
+func (d *Device) LastSeen() time.Time {
+	d.Lock()
+	defer d.Unlock()
+	return d.lastSeen
+}
+
+// watchdogTimeout returns the time after which the device goes KO without any value, 0 disables the watchdog
+// The operabilityTimeout key (s) of the device options takes precedence over OperabilityTimeout,
+// which falls back to 3 times the smallest frequency of the items
+// The device lock must be held
+func (d *Device) watchdogTimeout() time.Duration {
+	var deviceOptions struct {
+		OperabilityTimeout *int `json:"operabilityTimeout"`
+	}
+	if len(d.Options) > 0 && json.Unmarshal(d.Options, &deviceOptions) == nil && deviceOptions.OperabilityTimeout != nil {
+		return time.Duration(*deviceOptions.OperabilityTimeout) * time.Second
+	}
+
+	if d.OperabilityTimeout != 0 {
+		return d.OperabilityTimeout
+	}
+
+	var timeout time.Duration
+	for _, i := range d.Items {
+		if i.Driver == nil || i.Driver.Frequency == nil || *i.Driver.Frequency <= 0 {
+			continue
+		}
+		if t := watchdogFactor * time.Duration(*i.Driver.Frequency) * time.Second; timeout == 0 || t < timeout {
+			timeout = t
+		}
+	}
+	return timeout
+}
+
+// armWatchdog starts or restarts the operability timer, the device lock must be held
+func (d *Device) armWatchdog() {
+	timeout := d.watchdogTimeout()
+	if timeout <= 0 {
+		return
+	}
+
+	if d.timer == nil {
+		d.timer = time.AfterFunc(timeout, d.operabilityCBTimeout)
+	} else {
+		d.timer.Reset(timeout)
+	}
+}
+
+// seen records that a value of the device was published and re-arms the watchdog
+// A device which went KO because of the watchdog is operable again
+func (d *Device) seen(now time.Time) {
+	d.Lock()
+	d.lastSeen = now
+	d.armWatchdog()
+	wasLost := d.lost
+	d.lost = false
+	d.Unlock()
+
+	if d.properties != nil {
+		d.properties.SetMust(dbusDeviceInterface, propertyLastSeen, now.UnixNano()/int64(time.Millisecond))
+	}
+
+	if wasLost {
+		d.log.Info("Device", d.DevID, "seen again")
+		d.SetOperabilityState(OperabilityOk)
+		d.updateOperability()
+	}
+}
+
+// setLost sets the device KO until one of its values is published again
+func (d *Device) setLost() {
+	d.Lock()
+	d.lost = true
+	d.Unlock()
+
+	d.SetOperabilityState(OperabilityKo)
+}
+
+func (d *Device) stopWatchdog() {
+	d.Lock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.Unlock()
+}
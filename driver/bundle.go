@@ -0,0 +1,315 @@
+package driver
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	bundleManifest  = "manifest.json"
+	bundleSignature = "manifest.sig"
+
+	// BundleItem kind of a bundle file containing an hardware descriptor
+	BundleItem = "item"
+	// BundleDevice kind of a bundle file containing a device descriptor
+	BundleDevice = "device"
+
+	// MaxBundleSize maximum size of a bundle, and of all its files once extracted
+	MaxBundleSize = 16 << 20
+	// MaxBundleFileSize maximum size of a file of a bundle once extracted
+	MaxBundleFileSize = 1 << 20
+)
+
+// BundleManifest struct for the manifest of a driver bundle
+type BundleManifest struct {
+	Files []BundleFile `json:"files"`
+}
+
+// BundleFile struct for a descriptor of a driver bundle
+type BundleFile struct {
+	Path    string `json:"path"`
+	Kind    string `json:"kind"`
+	ID      string `json:"id"`
+	Version string `json:"version"`
+	SHA256  string `json:"sha256"`
+}
+
+// ImportBundle installs the descriptors of a signed tar.gz or zip bundle
+// A descriptor older than an installed version with the same major.minor is refused
+func (dm *DriversManager) ImportBundle(r io.Reader) error {
+	return dm.importBundle(r, false)
+}
+
+// ForceImportBundle installs the descriptors of a signed tar.gz or zip bundle, even if they are older than the installed ones
+func (dm *DriversManager) ForceImportBundle(r io.Reader) error {
+	return dm.importBundle(r, true)
+}
+
+func (dm *DriversManager) importBundle(r io.Reader, force bool) error {
+	data, err := readLimited(r, MaxBundleSize)
+	if err != nil {
+		return fmt.Errorf("bundle: %v", err)
+	}
+
+	files, err := readBundle(data)
+	if err != nil {
+		return err
+	}
+
+	manifestData, ok := files[bundleManifest]
+	if !ok {
+		return errors.New("bundle without " + bundleManifest)
+	}
+	if err := dm.verifySignature(manifestData, files[bundleSignature]); err != nil {
+		return err
+	}
+
+	var manifest BundleManifest
+	if err := json.Unmarshal(manifestData, &manifest); err != nil {
+		return fmt.Errorf("bundle manifest not valid: %v", err)
+	}
+
+	for _, f := range manifest.Files {
+		if err := dm.checkBundleFile(f, files[path.Clean(f.Path)], force); err != nil {
+			return err
+		}
+	}
+
+	if err := installBundle(manifest, files); err != nil {
+		return err
+	}
+
+	// The cached drivers may have been resolved to a version replaced by the bundle
+	dm.Lock()
+	dm.items = make(map[string]DriverItem)
+	dm.devices = make(map[string]DeviceDriver)
+	dm.Unlock()
+
+	log.Info("Driver bundle imported with", len(manifest.Files), "descriptors")
+	return nil
+}
+
+func (dm *DriversManager) verifySignature(manifest []byte, signature []byte) error {
+	if len(dm.TrustedKeys) == 0 {
+		return errors.New("no trusted key to verify the bundle")
+	}
+	if signature == nil {
+		return errors.New("bundle without " + bundleSignature)
+	}
+
+	// The signature may be stored raw or base64 encoded
+	if len(signature) != ed25519.SignatureSize {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+		if err != nil {
+			return fmt.Errorf("bundle signature not valid: %v", err)
+		}
+		signature = decoded
+	}
+
+	for _, key := range dm.TrustedKeys {
+		if len(key) == ed25519.PublicKeySize && ed25519.Verify(key, manifest, signature) {
+			return nil
+		}
+	}
+	return errors.New("bundle signature does not match any trusted key")
+}
+
+func (dm *DriversManager) checkBundleFile(f BundleFile, data []byte, force bool) error {
+	if f.ID == "" || f.Version == "" {
+		return fmt.Errorf("file %s of the manifest without id or version", f.Path)
+	}
+	if data == nil {
+		return fmt.Errorf("file %s of the manifest is missing from the bundle", f.Path)
+	}
+
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), f.SHA256) {
+		return fmt.Errorf("checksum of %s does not match the manifest", f.Path)
+	}
+
+	var dir string
+	switch f.Kind {
+	case BundleItem:
+		hd, err := ParseHardwareDescriptor(data, false)
+		if err != nil {
+			return fmt.Errorf("hardware descriptor %s not valid: %v", f.Path, err)
+		}
+		if d, ok := initDriverItem(*hd); ok && dm.SelfTestPolicy == SelfTestRefuse {
+			if errs := d.SelfTest(); len(errs) > 0 {
+				return fmt.Errorf("test vectors of %s fail: %v", f.Path, errs[0])
+			}
+		}
+		dir = itemsPath
+	case BundleDevice:
+		if err := json.Unmarshal(data, &DeviceDescriptor{}); err != nil {
+			return fmt.Errorf("device descriptor %s not valid: %v", f.Path, err)
+		}
+		dir = devicesPath
+	default:
+		return fmt.Errorf("unknown kind %q for %s", f.Kind, f.Path)
+	}
+
+	if force {
+		return nil
+	}
+
+	newVersion, ok := parseSemver(f.Version)
+	if !ok {
+		return nil
+	}
+	// The versions are stored side by side, only a newer patch of the same major.minor makes it a downgrade
+	for _, installed := range listVersions(dir, f.ID) {
+		if v, ok := parseSemver(installed); ok && v.compatible(newVersion, ResolvePatch) && newVersion.less(v) {
+			return fmt.Errorf("downgrade of %s from %s to %s refused", f.ID, installed, f.Version)
+		}
+	}
+	return nil
+}
+
+// installBundle writes the descriptors in a temporary dir, then moves them into the store
+// When a move fails, the files already moved are put back as they were
+func installBundle(manifest BundleManifest, files map[string][]byte) error {
+	for _, dir := range []string{itemsPath, devicesPath} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+
+	tmpDir, err := os.MkdirTemp(driversPath, ".import-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	targets := make([]string, len(manifest.Files))
+	for idx, f := range manifest.Files {
+		if f.Kind == BundleItem {
+			targets[idx] = itemPath(f.ID, f.Version)
+		} else {
+			targets[idx] = devicePath(f.ID, f.Version)
+		}
+		tmpFile := filepath.Join(tmpDir, fmt.Sprint(idx))
+		if err := os.WriteFile(tmpFile, files[path.Clean(f.Path)], 0644); err != nil {
+			return err
+		}
+	}
+
+	installed := 0
+	backups := make([]string, len(targets))
+	rollback := func() {
+		for idx := installed - 1; idx >= 0; idx-- {
+			os.Remove(targets[idx])
+			if backups[idx] != "" {
+				os.Rename(backups[idx], targets[idx])
+			}
+		}
+	}
+
+	for idx, target := range targets {
+		if _, err := os.Stat(target); err == nil {
+			backup := filepath.Join(tmpDir, fmt.Sprint(idx)+".bak")
+			if err := os.Rename(target, backup); err != nil {
+				rollback()
+				return err
+			}
+			backups[idx] = backup
+		}
+		installed = idx + 1
+		if err := os.Rename(filepath.Join(tmpDir, fmt.Sprint(idx)), target); err != nil {
+			rollback()
+			return err
+		}
+	}
+	return nil
+}
+
+// readLimited reads r entirely, it fails when r is larger than max bytes
+func readLimited(r io.Reader, max int64) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("larger than %d bytes", max)
+	}
+	return data, nil
+}
+
+// readBundle extracts the regular files of a tar.gz or zip archive
+// The files are limited to MaxBundleFileSize each and MaxBundleSize all together
+func readBundle(data []byte) (map[string][]byte, error) {
+	files := make(map[string][]byte)
+	var total int64
+	add := func(name string, r io.Reader) error {
+		content, err := readLimited(r, MaxBundleFileSize)
+		if err != nil {
+			return fmt.Errorf("file %s of the bundle: %v", name, err)
+		}
+		total += int64(len(content))
+		if total > MaxBundleSize {
+			return fmt.Errorf("bundle larger than %d bytes once extracted", MaxBundleSize)
+		}
+		files[path.Clean(name)] = content
+		return nil
+	}
+
+	switch {
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return nil, err
+			}
+			if header.Typeflag != tar.TypeReg {
+				continue
+			}
+			if err := add(header.Name, tr); err != nil {
+				return nil, err
+			}
+		}
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range zr.File {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			rc, err := f.Open()
+			if err != nil {
+				return nil, err
+			}
+			err = add(f.Name, rc)
+			rc.Close()
+			if err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, errors.New("bundle is neither a tar.gz nor a zip archive")
+	}
+
+	return files, nil
+}
@@ -0,0 +1,166 @@
+package driver
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const bundleDescriptor = `{"sensor": true, "requestFrame": "temp", "formulas": {"STANDARD": {"map": ""}}}`
+
+// useTempStore moves the driver store into a temporary dir for the duration of the test
+func useTempStore(t *testing.T) {
+	oldDrivers, oldItems, oldDevices := driversPath, itemsPath, devicesPath
+	driversPath = t.TempDir() + "/"
+	itemsPath = driversPath + "items/"
+	devicesPath = driversPath + "devices/"
+	t.Cleanup(func() {
+		driversPath, itemsPath, devicesPath = oldDrivers, oldItems, oldDevices
+	})
+}
+
+func newTestManager(t *testing.T) (*DriversManager, ed25519.PrivateKey) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dm := &DriversManager{TrustedKeys: []ed25519.PublicKey{public}}
+	dm.InitDriversManager()
+	return dm, private
+}
+
+// buildBundle returns a tar.gz bundle with the descriptors and a manifest signed with key
+// tamper is called on the files before they are archived
+func buildBundle(t *testing.T, key ed25519.PrivateKey, files []BundleFile, contents map[string]string, tamper func(map[string][]byte)) []byte {
+	archived := make(map[string][]byte)
+	for idx, f := range files {
+		sum := sha256.Sum256([]byte(contents[f.Path]))
+		files[idx].SHA256 = hex.EncodeToString(sum[:])
+		archived[f.Path] = []byte(contents[f.Path])
+	}
+
+	manifest, err := json.Marshal(BundleManifest{Files: files})
+	if err != nil {
+		t.Fatal(err)
+	}
+	archived[bundleManifest] = manifest
+	archived[bundleSignature] = ed25519.Sign(key, manifest)
+	if tamper != nil {
+		tamper(archived)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for name, content := range archived {
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tw.Close()
+	gz.Close()
+	return buf.Bytes()
+}
+
+func itemBundle(t *testing.T, key ed25519.PrivateKey, version string, tamper func(map[string][]byte)) []byte {
+	files := []BundleFile{{Path: "items/temp.json", Kind: BundleItem, ID: "temp", Version: version}}
+	return buildBundle(t, key, files, map[string]string{"items/temp.json": bundleDescriptor}, tamper)
+}
+
+func TestImportBundle(t *testing.T) {
+	useTempStore(t)
+	dm, key := newTestManager(t)
+
+	if err := dm.ImportBundle(bytes.NewReader(itemBundle(t, key, "1.2.0", nil))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(itemPath("temp", "1.2.0")); err != nil {
+		t.Errorf("descriptor not installed: %v", err)
+	}
+	if _, ok := dm.GetDriverItem("temp", "1.2.0"); !ok {
+		t.Error("installed driver not found")
+	}
+
+	entries, _ := os.ReadDir(driversPath)
+	for _, entry := range entries {
+		if entry.Name() != "items" && entry.Name() != "devices" {
+			t.Errorf("temporary file %s left in the store", entry.Name())
+		}
+	}
+}
+
+func TestImportBundleTampered(t *testing.T) {
+	useTempStore(t)
+	dm, key := newTestManager(t)
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	tests := map[string][]byte{
+		"untrusted key": itemBundle(t, otherKey, "1.0.0", nil),
+		"descriptor changed": itemBundle(t, key, "1.0.0", func(files map[string][]byte) {
+			files["items/temp.json"] = []byte(`{"sensor": false}`)
+		}),
+		"manifest changed": itemBundle(t, key, "1.0.0", func(files map[string][]byte) {
+			files[bundleManifest] = bytes.Replace(files[bundleManifest], []byte("1.0.0"), []byte("9.0.0"), 1)
+		}),
+		"signature missing": itemBundle(t, key, "1.0.0", func(files map[string][]byte) {
+			delete(files, bundleSignature)
+		}),
+		"file too large": itemBundle(t, key, "1.0.0", func(files map[string][]byte) {
+			files["padding"] = make([]byte, MaxBundleFileSize+1)
+		}),
+	}
+
+	for name, bundle := range tests {
+		if err := dm.ImportBundle(bytes.NewReader(bundle)); err == nil {
+			t.Errorf("%s: bundle accepted", name)
+		}
+	}
+	if versions := dm.ListVersions("temp"); len(versions) != 0 {
+		t.Errorf("tampered bundles installed %v", versions)
+	}
+}
+
+func TestImportBundleDowngrade(t *testing.T) {
+	useTempStore(t)
+	dm, key := newTestManager(t)
+
+	for _, version := range []string{"1.2.5", "2.0.0"} {
+		if err := dm.ImportBundle(bytes.NewReader(itemBundle(t, key, version, nil))); err != nil {
+			t.Fatalf("import of %s: %v", version, err)
+		}
+	}
+
+	if err := dm.ImportBundle(bytes.NewReader(itemBundle(t, key, "1.2.3", nil))); err == nil {
+		t.Error("downgrade from 1.2.5 to 1.2.3 accepted")
+	}
+	if err := dm.ImportBundle(bytes.NewReader(itemBundle(t, key, "1.1.0", nil))); err != nil {
+		t.Errorf("import of 1.1.0 next to 1.2.5 refused: %v", err)
+	}
+	if err := dm.ForceImportBundle(bytes.NewReader(itemBundle(t, key, "1.2.3", nil))); err != nil {
+		t.Errorf("forced downgrade refused: %v", err)
+	}
+
+	if _, err := os.Stat(filepath.Join(itemsPath, "temp-1_2_3.json")); err != nil {
+		t.Errorf("forced descriptor not installed: %v", err)
+	}
+}
+
+func TestImportBundleWithoutVersion(t *testing.T) {
+	useTempStore(t)
+	dm, key := newTestManager(t)
+
+	if err := dm.ImportBundle(bytes.NewReader(itemBundle(t, key, "", nil))); err == nil {
+		t.Error("bundle without version accepted")
+	}
+}
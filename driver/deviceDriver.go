@@ -0,0 +1,86 @@
+package driver
+
+import (
+	"encoding/json"
+	"time"
+)
+
+var (
+	devicesPath = driversPath + "devices/"
+)
+
+// DeviceDescriptor struct for the descriptor of a device type
+type DeviceDescriptor struct {
+	Items                []DeviceItemDescriptor `json:"items"`
+	Pairing              *PairingDescriptor     `json:"pairing,omitempty"`
+	OperabilityTimeout   *int                   `json:"operabilityTimeout,omitempty"`
+	FirmwareUpdateMethod *string                `json:"firmwareUpdateMethod,omitempty"`
+	OptionsSchema        json.RawMessage        `json:"optionsSchema,omitempty"`
+}
+
+// DeviceItemDescriptor struct for an item exposed by default by a device type
+type DeviceItemDescriptor struct {
+	ItemID          string          `json:"itemID"`
+	ItemTypeID      string          `json:"itemTypeID"`
+	ItemTypeVersion string          `json:"itemTypeVersion"`
+	ItemOptions     json.RawMessage `json:"itemOptions,omitempty"`
+}
+
+// PairingDescriptor struct for the pairing procedure of a device type
+type PairingDescriptor struct {
+	Procedure string `json:"procedure"`
+	Timeout   *int   `json:"timeout,omitempty"`
+}
+
+// DeviceDriver driver for a device type
+type DeviceDriver struct {
+	Type                 string
+	Version              string
+	Items                []DeviceItemDescriptor
+	PairingProcedure     string
+	PairingTimeout       time.Duration
+	OperabilityTimeout   time.Duration
+	FirmwareUpdateMethod string
+	// OptionsSchema schema of the options of the devices, nil when the options are not checked
+	OptionsSchema *Schema
+	DDesc         *DeviceDescriptor
+}
+
+func initDeviceDriver(id string, version string, dd DeviceDescriptor) *DeviceDriver {
+	driver := &DeviceDriver{
+		Type:    id,
+		Version: version,
+		Items:   dd.Items,
+		DDesc:   &dd,
+	}
+
+	if dd.Pairing != nil {
+		driver.PairingProcedure = dd.Pairing.Procedure
+		if dd.Pairing.Timeout != nil {
+			driver.PairingTimeout = time.Duration(*dd.Pairing.Timeout) * time.Second
+		}
+	}
+
+	if dd.OperabilityTimeout != nil {
+		driver.OperabilityTimeout = time.Duration(*dd.OperabilityTimeout) * time.Second
+	}
+
+	if dd.FirmwareUpdateMethod != nil {
+		driver.FirmwareUpdateMethod = *dd.FirmwareUpdateMethod
+	}
+
+	if len(dd.OptionsSchema) > 0 {
+		schema, err := ParseSchema(dd.OptionsSchema)
+		if err != nil {
+			log.Warning("Options schema of the device driver", id, version, "ignored:", err)
+		} else {
+			driver.OptionsSchema = schema
+		}
+	}
+
+	return driver
+}
+
+func devicePath(id string, version string) string {
+	return driverPath(devicesPath, id, version)
+}
@@ -4,22 +4,31 @@ import (
 	"regexp"
 )
 
-const (
-	itemsPath = "/data/opencaps/drivers/items/"
+// The driver store, variables so that it can be moved
+var (
+	driversPath = "/data/opencaps/drivers/"
+	itemsPath   = driversPath + "items/"
 )
 
 // DriverItem driver for an item type
 type DriverItem struct {
 	Type          string
+	Version       string
 	Read          Translation
 	Write         Translation
 	Frequency     *int
 	IsSensor      bool
 	PairingNeeded bool
 	HDesc         *HardwareDescriptor
+
+	// OptionsSchema schema of the options of the items, nil when the options are not checked
+	OptionsSchema *Schema
+
+	// SelfTestErrors test vectors failures found when the driver was loaded
+	SelfTestErrors []error
 }
 
-var itemPathRegex, _ = regexp.Compile("[^a-zA-Z0-9_]")
+var driverPathRegex, _ = regexp.Compile("[^a-zA-Z0-9_]")
 
 func initDriverItem(hd HardwareDescriptor) (*DriverItem, bool) {
 	driver := &DriverItem{HDesc: &hd}
@@ -61,12 +70,25 @@ func initDriverItem(hd HardwareDescriptor) (*DriverItem, bool) {
 	driver.IsSensor = hd.IsSensor
 	driver.PairingNeeded = hd.PairingNeeded
 
+	if len(hd.OptionsSchema) > 0 {
+		schema, err := ParseSchema(hd.OptionsSchema)
+		if err != nil {
+			log.Warning("Options schema of the hardware descriptor not valid:", err)
+			return nil, false
+		}
+		driver.OptionsSchema = schema
+	}
+
 	return driver, true
 }
 
 func itemPath(id string, version string) string {
-	id = itemPathRegex.ReplaceAllString(id, "_")
-	version = itemPathRegex.ReplaceAllString(version, "_")
+	return driverPath(itemsPath, id, version)
+}
+
+func driverPath(dir string, id string, version string) string {
+	id = driverPathRegex.ReplaceAllString(id, "_")
+	version = driverPathRegex.ReplaceAllString(version, "_")
 
-	return itemsPath + id + "-" + version + ".json"
+	return dir + id + "-" + version + ".json"
 }
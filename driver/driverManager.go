@@ -1,8 +1,8 @@
 package driver
 
 import (
+	"crypto/ed25519"
 	"encoding/json"
-	"io"
 	"os"
 	"sync"
 
@@ -11,7 +11,18 @@ import (
 
 // DriversManager contains all the driver known by the firmware
 type DriversManager struct {
-	items map[string]DriverItem
+	// SelfTestPolicy tells what to do with the test vectors of the descriptors loaded from the disk
+	SelfTestPolicy SelfTestPolicy
+	// VersionPolicy tells which version to use when the requested version of an item driver is missing
+	VersionPolicy VersionPolicy
+	// TrustedKeys public keys accepted for the signature of the driver bundles
+	TrustedKeys []ed25519.PublicKey
+
+	items         map[string]DriverItem
+	devices       map[string]DeviceDriver
+	pins          map[string]string
+	itemSchemas   map[string]*Schema
+	deviceSchemas map[string]*Schema
 	sync.Mutex
 }
 
@@ -20,9 +31,12 @@ var log = logging.MustGetLogger("dbus-adapter")
 // InitDriversManager init the the struct
 func (dm *DriversManager) InitDriversManager() {
 	dm.items = make(map[string]DriverItem)
-	// Create item dir if not existing
-	if _, err := os.Stat(itemsPath); os.IsNotExist(err) {
-		os.MkdirAll(itemsPath, 0755)
+	dm.devices = make(map[string]DeviceDriver)
+	// Create the driver dirs if not existing
+	for _, dir := range []string{itemsPath, devicesPath} {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			os.MkdirAll(dir, 0755)
+		}
 	}
 }
 
@@ -37,7 +51,15 @@ func (dm *DriversManager) getItem(id string, version string) (*DriverItem, bool)
 
 // GetDriverItem to get a driver item
 // If the item is not in the struct, the function will try to find it on the disk
+// A pinned version replaces the requested one, and when the exact version is missing
+// the closest compatible version is used according to the VersionPolicy
 func (dm *DriversManager) GetDriverItem(id string, version string) (*DriverItem, bool) {
+	dm.Lock()
+	if pinned, ok := dm.pins[id]; ok {
+		version = pinned
+	}
+	dm.Unlock()
+
 	driver, driverFound := dm.getItem(id, version)
 
 	if driverFound {
@@ -46,44 +68,193 @@ func (dm *DriversManager) GetDriverItem(id string, version string) (*DriverItem,
 
 	log.Info("Try to find the driver from the disk")
 
-	path := itemPath(id, version)
-	jsonFile, err := os.Open(path)
-	if err != nil {
-		log.Warning("unable to open the item driver from", path)
+	resolved := version
+	if _, err := os.Stat(itemPath(id, version)); os.IsNotExist(err) && dm.VersionPolicy != ResolveExact {
+		var ok bool
+		resolved, ok = resolveVersion(dm.ListVersions(id), version, dm.VersionPolicy)
+		if !ok {
+			log.Warning("No compatible version of the item driver", id, version)
+			return nil, false
+		}
+		log.Info("Item driver", id, version, "resolved to version", resolved)
+
+		// The resolution is done again on each miss so that an exact version installed later is used
+		if driver, driverFound = dm.getItem(id, resolved); driverFound {
+			return driver, driverFound
+		}
+	}
+
+	driver, driverFound = dm.loadDriverItem(id, resolved)
+	if !driverFound {
 		return nil, false
 	}
-	defer jsonFile.Close()
 
-	byteValue, err := io.ReadAll(jsonFile)
+	dm.Lock()
+	dm.items[driverName(id, resolved)] = *driver
+	dm.Unlock()
+
+	return driver, driverFound
+}
+
+func (dm *DriversManager) loadDriverItem(id string, version string) (*DriverItem, bool) {
+	path := itemPath(id, version)
+	byteValue, err := os.ReadFile(path)
 	if err != nil {
 		log.Warning("unable to read the item driver from", path)
 		return nil, false
 	}
 
-	driverFound = true
-
-	hd := HardwareDescriptor{}
-	err = json.Unmarshal(byteValue, &hd)
+	hd, err := ParseHardwareDescriptor(byteValue, false)
 	if err != nil {
 		log.Warning("Fail to deserialize the hardware descriptor:", id, version, err)
 		return nil, false
 	}
 
-	driver, ok := initDriverItem(hd)
+	driver, ok := initDriverItem(*hd)
 	if !ok {
 		log.Warning("Fail to generate a driver item from the hardware descriptor:", id, version, err)
 		return nil, false
 	}
+	driver.Version = version
+
+	if dm.SelfTestPolicy != SelfTestIgnore {
+		driver.SelfTestErrors = driver.SelfTest()
+		for _, err := range driver.SelfTestErrors {
+			log.Warning("Test vector of the driver", id, version, "failed:", err)
+		}
+		if len(driver.SelfTestErrors) > 0 && dm.SelfTestPolicy == SelfTestRefuse {
+			log.Error("Driver", id, version, "refused because its test vectors fail")
+			return nil, false
+		}
+	}
 
 	log.Info("Driver from disk:", driver)
+	return driver, true
+}
 
+// ListVersions returns the versions of the item driver id available on the disk, from the oldest to the newest
+func (dm *DriversManager) ListVersions(id string) []string {
+	return listVersions(itemsPath, id)
+}
+
+// PinVersion forces the version of the item driver id, whatever the requested version
+func (dm *DriversManager) PinVersion(id string, version string) {
 	dm.Lock()
-	dm.items[driverName(id, version)] = *driver
+	if dm.pins == nil {
+		dm.pins = make(map[string]string)
+	}
+	dm.pins[id] = version
 	dm.Unlock()
+}
 
-	return driver, driverFound
+// UnpinVersion removes the pinned version of the item driver id
+func (dm *DriversManager) UnpinVersion(id string) {
+	dm.Lock()
+	delete(dm.pins, id)
+	dm.Unlock()
+}
+
+// GetDeviceDriver to get the driver of a device type
+// If the device type is not in the struct, the function will try to find it on the disk
+func (dm *DriversManager) GetDeviceDriver(id string, version string) (*DeviceDriver, bool) {
+	name := driverName(id, version)
+	dm.Lock()
+	driver, driverFound := dm.devices[name]
+	dm.Unlock()
+
+	if driverFound {
+		return &driver, driverFound
+	}
+
+	path := devicePath(id, version)
+	byteValue, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Info("No device driver for", id, version)
+		return nil, false
+	} else if err != nil {
+		log.Warning("unable to read the device driver from", path, err)
+		return nil, false
+	}
+
+	dd := DeviceDescriptor{}
+	err = json.Unmarshal(byteValue, &dd)
+	if err != nil {
+		log.Warning("Fail to deserialize the device descriptor:", id, version, err)
+		return nil, false
+	}
+
+	dev := initDeviceDriver(id, version, dd)
+	log.Info("Device driver from disk:", dev)
+
+	dm.Lock()
+	dm.devices[name] = *dev
+	dm.Unlock()
+
+	return dev, true
 }
 
 func driverName(id string, version string) string {
 	return id + version
 }
+
+// RegisterItemOptionsSchema sets the schema of the options of the items of type id, whatever their version
+// It takes precedence over the optionsSchema of the hardware descriptors, nil removes it
+// and the optionsSchema of the descriptors applies again
+func (dm *DriversManager) RegisterItemOptionsSchema(id string, schema *Schema) {
+	dm.Lock()
+	if schema == nil {
+		delete(dm.itemSchemas, id)
+	} else {
+		if dm.itemSchemas == nil {
+			dm.itemSchemas = make(map[string]*Schema)
+		}
+		dm.itemSchemas[id] = schema
+	}
+	dm.Unlock()
+}
+
+// RegisterDeviceOptionsSchema sets the schema of the options of the devices of type id, whatever their version
+// It takes precedence over the optionsSchema of the device descriptors, nil removes it
+// and the optionsSchema of the descriptors applies again
+func (dm *DriversManager) RegisterDeviceOptionsSchema(id string, schema *Schema) {
+	dm.Lock()
+	if schema == nil {
+		delete(dm.deviceSchemas, id)
+	} else {
+		if dm.deviceSchemas == nil {
+			dm.deviceSchemas = make(map[string]*Schema)
+		}
+		dm.deviceSchemas[id] = schema
+	}
+	dm.Unlock()
+}
+
+// ItemOptionsSchema returns the schema of the options of the items of type id/version, nil if there is none
+func (dm *DriversManager) ItemOptionsSchema(id string, version string) *Schema {
+	dm.Lock()
+	schema, registered := dm.itemSchemas[id]
+	dm.Unlock()
+	if registered {
+		return schema
+	}
+
+	if driver, ok := dm.GetDriverItem(id, version); ok {
+		return driver.OptionsSchema
+	}
+	return nil
+}
+
+// DeviceOptionsSchema returns the schema of the options of the devices of type id/version, nil if there is none
+func (dm *DriversManager) DeviceOptionsSchema(id string, version string) *Schema {
+	dm.Lock()
+	schema, registered := dm.deviceSchemas[id]
+	dm.Unlock()
+	if registered {
+		return schema
+	}
+
+	if driver, ok := dm.GetDeviceDriver(id, version); ok {
+		return driver.OptionsSchema
+	}
+	return nil
+}
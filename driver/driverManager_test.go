@@ -0,0 +1,28 @@
+package driver
+
+import (
+	"os"
+	"testing"
+)
+
+func TestGetDriverItemExactVersionInstalledLater(t *testing.T) {
+	useTempStore(t)
+	dm := &DriversManager{VersionPolicy: ResolvePatch}
+	dm.InitDriversManager()
+
+	if err := os.WriteFile(itemPath("temp", "1.2.0"), []byte(bundleDescriptor), 0644); err != nil {
+		t.Fatal(err)
+	}
+	driver, ok := dm.GetDriverItem("temp", "1.2.3")
+	if !ok || driver.Version != "1.2.0" {
+		t.Fatalf("1.2.3 resolved to %v, expected 1.2.0", driver)
+	}
+
+	if err := os.WriteFile(itemPath("temp", "1.2.3"), []byte(bundleDescriptor), 0644); err != nil {
+		t.Fatal(err)
+	}
+	driver, ok = dm.GetDriverItem("temp", "1.2.3")
+	if !ok || driver.Version != "1.2.3" {
+		t.Fatalf("1.2.3 resolved to %v once installed", driver)
+	}
+}
@@ -1,5 +1,9 @@
 package driver
 
+import (
+	"encoding/json"
+)
+
 // HardwareDescriptor struct for an hardware descriptor from hemis
 type HardwareDescriptor struct {
 	IsSensor            bool               `json:"sensor"`
@@ -14,9 +18,12 @@ type HardwareDescriptor struct {
 	UsesTriggers        *bool              `json:"usesTriggers,omitempty"`
 	ExtendedType        *string            `json:"extendedType,omitempty"`
 	ResetValue          *float64           `json:"resetValue,omitempty"`
+	ResetDelay          *int               `json:"resetDelay,omitempty"`
 	Formula             map[string]Formula `json:"formulas"`
 	Frequency           *int               `json:"frequency,omitempty"`
 	PairingNeeded       bool               `json:"pairingNeeded,omitempty"`
+	TestVectors         *TestVectors       `json:"testVectors,omitempty"`
+	OptionsSchema       json.RawMessage    `json:"optionsSchema,omitempty"`
 
 	// For sensor
 	RequestFrame *string `json:"requestFrame,omitempty"`
@@ -53,3 +60,17 @@ type Formula struct {
 	ChannelIndexToExtract *int     `json:"channelIndexToExtract,omitempty"`
 	HasFrameCounter       *bool    `json:"hasFrameCounter,omitempty"`
 }
+
+// TestVectors struct for the test vectors embedded in an hardware descriptor
+type TestVectors struct {
+	// Read vectors check the translation of a raw frame into a value
+	Read []TestVector `json:"read,omitempty"`
+	// Write vectors check the translation of a target value into a frame
+	Write []TestVector `json:"write,omitempty"`
+}
+
+// TestVector struct for a test vector
+type TestVector struct {
+	Frame interface{} `json:"frame"`
+	Value interface{} `json:"value"`
+}
@@ -0,0 +1,142 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	formulaStandard = "STANDARD"
+	formulaState    = "STATE"
+)
+
+// LoadHardwareDescriptor reads and deserializes the hardware descriptor stored at path
+func LoadHardwareDescriptor(path string) (*HardwareDescriptor, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseHardwareDescriptor(data, false)
+}
+
+// ParseHardwareDescriptor deserializes a hardware descriptor
+// When strict is true, unknown fields are reported as an error
+func ParseHardwareDescriptor(data []byte, strict bool) (*HardwareDescriptor, error) {
+	hd := &HardwareDescriptor{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(hd); err != nil {
+		return nil, err
+	}
+	return hd, nil
+}
+
+// NewDriverItem generates the driver item described by a hardware descriptor
+func NewDriverItem(hd HardwareDescriptor) (*DriverItem, bool) {
+	return initDriverItem(hd)
+}
+
+// ItemPath returns the file where the driver of the item id/version is stored
+func ItemPath(id string, version string) string {
+	return itemPath(id, version)
+}
+
+// ParseValue converts a textual value the same way the formula maps are parsed
+func ParseValue(data string) interface{} {
+	return convert(data)
+}
+
+// Lint checks the consistency of the hardware descriptor and returns all the problems found
+func (hd *HardwareDescriptor) Lint() []error {
+	var errs []error
+	report := func(format string, args ...interface{}) {
+		errs = append(errs, fmt.Errorf(format, args...))
+	}
+
+	if hd.IsSensor {
+		if hd.RequestFrame == nil {
+			report("sensor without requestFrame")
+		}
+		if _, ok := hd.Formula[formulaStandard]; !ok {
+			report("sensor without %s formula", formulaStandard)
+		}
+	} else {
+		if hd.AckFrame == nil && hd.StateRequestFrame == nil {
+			report("actuator without ackFrame nor stateRequestFrame")
+		}
+		if _, ok := hd.Formula[formulaStandard]; !ok {
+			report("actuator without %s formula", formulaStandard)
+		}
+	}
+
+	if hd.Frequency != nil && *hd.Frequency <= 0 {
+		report("frequency must be positive, got %d", *hd.Frequency)
+	}
+	if hd.ResetDelay != nil && *hd.ResetDelay <= 0 {
+		report("resetDelay must be positive, got %d", *hd.ResetDelay)
+	}
+	if hd.ResetDelay != nil && hd.ResetValue == nil {
+		report("resetDelay without resetValue")
+	}
+	if hd.StateRequestDelay != nil && *hd.StateRequestDelay < 0 {
+		report("stateRequestDelay must not be negative, got %d", *hd.StateRequestDelay)
+	}
+
+	if len(hd.OptionsSchema) > 0 {
+		if _, err := ParseSchema(hd.OptionsSchema); err != nil {
+			report("optionsSchema: %v", err)
+		}
+	}
+
+	for name, formula := range hd.Formula {
+		if name != formulaStandard && name != formulaState {
+			report("formula %s: unknown formula name", name)
+		}
+		for _, err := range formula.lint() {
+			report("formula %s: %v", name, err)
+		}
+	}
+
+	return errs
+}
+
+func (f *Formula) lint() []error {
+	var errs []error
+
+	if f.A != nil && *f.A == 0 {
+		errs = append(errs, fmt.Errorf("coefficient a must not be 0"))
+	}
+	if f.ValueFirstIndex != nil && f.ValueLastIndex != nil && *f.ValueFirstIndex > *f.ValueLastIndex {
+		errs = append(errs, fmt.Errorf("valueFirstIndex %d is after valueLastIndex %d", *f.ValueFirstIndex, *f.ValueLastIndex))
+	}
+	if f.DIVFirstIndex != nil && f.DIVLastIndex != nil && *f.DIVFirstIndex > *f.DIVLastIndex {
+		errs = append(errs, fmt.Errorf("divFirstIndex %d is after divLastIndex %d", *f.DIVFirstIndex, *f.DIVLastIndex))
+	}
+
+	if f.Map == "" {
+		return errs
+	}
+
+	keys := make(map[interface{}]bool)
+	for _, tupleRaw := range strings.Split(f.Map, ";") {
+		tuple := strings.ReplaceAll(tupleRaw, "(", "")
+		tuple = strings.ReplaceAll(tuple, ")", "")
+		keyValue := strings.Split(tuple, ",")
+		if len(keyValue) != 2 {
+			errs = append(errs, fmt.Errorf("map tuple not valid: %q", tupleRaw))
+			continue
+		}
+		key := convert(keyValue[0])
+		if keys[key] {
+			errs = append(errs, fmt.Errorf("map key %v defined more than once", key))
+		}
+		keys[key] = true
+	}
+
+	return errs
+}
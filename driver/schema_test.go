@@ -0,0 +1,77 @@
+package driver
+
+import (
+	"testing"
+)
+
+func TestSchemaValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		schema string
+		data   string
+		errs   int
+	}{
+		{"type", `{"type": "string"}`, `"a"`, 0},
+		{"wrong type", `{"type": "string"}`, `1`, 1},
+		{"type list", `{"type": ["string", "null"]}`, `null`, 0},
+		{"type list mismatch", `{"type": ["string", "null"]}`, `true`, 1},
+		{"integer", `{"type": "integer"}`, `3`, 0},
+		{"integer with decimals", `{"type": "integer"}`, `3.5`, 1},
+		{"number accepts integer", `{"type": "number"}`, `3`, 0},
+		{"number", `{"type": "number"}`, `3.5`, 0},
+		{"minimum", `{"type": "number", "minimum": 1, "maximum": 2}`, `0.5`, 1},
+		{"maximum", `{"type": "number", "minimum": 1, "maximum": 2}`, `2.5`, 1},
+		{"required", `{"type": "object", "required": ["a", "b"]}`, `{"a": 1}`, 1},
+		{"required present", `{"type": "object", "required": ["a"]}`, `{"a": 1}`, 0},
+		{"properties", `{"properties": {"a": {"type": "string"}, "b": {"type": "boolean"}}}`, `{"a": 1, "b": 2}`, 2},
+		{"no additional properties", `{"properties": {"a": {}}, "additionalProperties": false}`, `{"a": 1, "b": 2}`, 1},
+		{"additional properties allowed", `{"properties": {"a": {}}, "additionalProperties": true}`, `{"a": 1, "b": 2}`, 0},
+		{"additional properties schema", `{"properties": {"a": {}}, "additionalProperties": {"type": "integer"}}`, `{"a": "x", "b": 2, "c": "3"}`, 1},
+		{"items", `{"type": "array", "items": {"type": "integer"}}`, `[1, "2", 3.5]`, 2},
+		{"minItems", `{"type": "array", "minItems": 2}`, `[1]`, 1},
+		{"maxItems", `{"type": "array", "maxItems": 2}`, `[1, 2, 3]`, 1},
+		{"items in bounds", `{"type": "array", "minItems": 1, "maxItems": 2}`, `[1, 2]`, 0},
+		{"minLength", `{"type": "string", "minLength": 2}`, `"é"`, 1},
+		{"maxLength", `{"type": "string", "maxLength": 2}`, `"éé"`, 0},
+		{"pattern", `{"type": "string", "pattern": "^[0-9a-f]{4}$"}`, `"12ab"`, 0},
+		{"pattern mismatch", `{"type": "string", "pattern": "^[0-9a-f]{4}$"}`, `"12abc"`, 1},
+		{"enum numbers", `{"enum": [1, 2.5]}`, `2.5`, 0},
+		{"enum integer written as decimal", `{"enum": [1, 2.5]}`, `1.0`, 0},
+		{"enum mismatch", `{"enum": [1, "a"]}`, `"1"`, 1},
+		{"nested path", `{"properties": {"a": {"properties": {"b": {"enum": [true]}}}}}`, `{"a": {"b": false}}`, 1},
+		{"trailing data", `{"type": "object"}`, `{} {}`, 1},
+		{"malformed", `{"type": "object"}`, `{"a":`, 1},
+	}
+
+	for _, test := range tests {
+		schema, err := ParseSchema([]byte(test.schema))
+		if err != nil {
+			t.Errorf("%s: ParseSchema failed: %v", test.name, err)
+			continue
+		}
+		if errs := schema.Validate([]byte(test.data)); len(errs) != test.errs {
+			t.Errorf("%s: %s returned %d errors, expected %d: %v", test.name, test.data, len(errs), test.errs, errs)
+		}
+	}
+}
+
+func TestParseSchemaErrors(t *testing.T) {
+	tests := map[string]string{
+		"not JSON":                         `{"type":`,
+		"unknown type":                     `{"type": "float"}`,
+		"type not a string":                `{"type": 1}`,
+		"unknown type in list":             `{"type": ["string", "date"]}`,
+		"bad pattern":                      `{"pattern": "("}`,
+		"bad additionalProperties":         `{"additionalProperties": 1}`,
+		"bad type in additionalProperties": `{"additionalProperties": {"type": "float"}}`,
+		"bad nested property":              `{"properties": {"a": {"type": "float"}}}`,
+		"null property":                    `{"properties": {"a": null}}`,
+		"bad items":                        `{"items": {"pattern": "["}}`,
+	}
+
+	for name, schema := range tests {
+		if _, err := ParseSchema([]byte(schema)); err == nil {
+			t.Errorf("%s: %s accepted", name, schema)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package driver
+
+import (
+	"fmt"
+	"reflect"
+)
+
+const (
+	// SelfTestIgnore the test vectors are not run when a driver is loaded
+	SelfTestIgnore SelfTestPolicy = iota
+	// SelfTestFlag the failures are logged and stored in DriverItem.SelfTestErrors
+	SelfTestFlag
+	// SelfTestRefuse a driver with a failing test vector is not loaded
+	SelfTestRefuse
+)
+
+// SelfTestPolicy tells the DriversManager what to do with the test vectors of a descriptor
+type SelfTestPolicy int
+
+// SelfTest runs the test vectors of the hardware descriptor through the translations
+// and returns one error per mismatch
+func (d *DriverItem) SelfTest() []error {
+	if d.HDesc == nil || d.HDesc.TestVectors == nil {
+		return nil
+	}
+
+	var errs []error
+	for idx, vector := range d.HDesc.TestVectors.Read {
+		if vector.Frame == nil || vector.Value == nil {
+			errs = append(errs, fmt.Errorf("read vector %d: frame and value are required", idx))
+			continue
+		}
+		got := d.Read.Translate(vector.Frame)
+		if !sameValue(got, vector.Value) {
+			errs = append(errs, fmt.Errorf("read vector %d: frame %v decoded to %v (%T), expected %v (%T)",
+				idx, vector.Frame, got, got, vector.Value, vector.Value))
+		}
+	}
+	for idx, vector := range d.HDesc.TestVectors.Write {
+		if vector.Frame == nil || vector.Value == nil {
+			errs = append(errs, fmt.Errorf("write vector %d: frame and value are required", idx))
+			continue
+		}
+		got := d.Write.Translate(vector.Value)
+		if !sameValue(got, vector.Frame) {
+			errs = append(errs, fmt.Errorf("write vector %d: value %v encoded to %v (%T), expected %v (%T)",
+				idx, vector.Value, got, got, vector.Frame, vector.Frame))
+		}
+	}
+
+	return errs
+}
+
+// sameValue compares two values, numbers are compared whatever their type
+func sameValue(a interface{}, b interface{}) bool {
+	fa, aIsNumber := toFloat(a)
+	fb, bIsNumber := toFloat(b)
+	if aIsNumber && bIsNumber {
+		return fa == fb
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	}
+	return 0, false
+}
@@ -0,0 +1,46 @@
+package driver
+
+import (
+	"testing"
+)
+
+const incompleteVectorsDescriptor = `{
+	"sensor": true,
+	"requestFrame": "state",
+	"formulas": {"STANDARD": {"map": "(1,ON);(0,OFF)"}},
+	"testVectors": {
+		"read": [
+			{"frame": 1, "value": "ON"},
+			{"value": "OFF"},
+			{"frame": null, "value": "OFF"},
+			{"frame": 0}
+		]
+	}
+}`
+
+func TestSelfTestIncompleteVector(t *testing.T) {
+	hd, err := ParseHardwareDescriptor([]byte(incompleteVectorsDescriptor), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The incomplete vectors are only reported by SelfTest
+	if errs := hd.Lint(); len(errs) != 0 {
+		t.Errorf("Lint returned %d errors, expected none: %v", len(errs), errs)
+	}
+
+	driver, ok := NewDriverItem(*hd)
+	if !ok {
+		t.Fatal("driver not generated")
+	}
+	if errs := driver.SelfTest(); len(errs) != 3 {
+		t.Errorf("SelfTest returned %d errors, expected 3: %v", len(errs), errs)
+	}
+}
+
+func TestTranslateNil(t *testing.T) {
+	translation := Translation{A: 1, Map: map[interface{}]interface{}{1.0: "ON"}}
+	if got := translation.Translate(nil); got != nil {
+		t.Errorf("Translate(nil) = %v, expected nil", got)
+	}
+}
@@ -115,6 +115,10 @@ func (t *Translation) translateCoeff(value interface{}) interface{} {
 }
 
 func (t *Translation) translateMap(data interface{}) interface{} {
+	if data == nil {
+		return nil
+	}
+
 	if len(t.Map) > 0 {
 		for key, value := range t.Map {
 			if key == data {
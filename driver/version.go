@@ -0,0 +1,124 @@
+package driver
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	// ResolveExact only the requested version is used
+	ResolveExact VersionPolicy = iota
+	// ResolvePatch the highest version with the same major and minor numbers is used
+	ResolvePatch
+	// ResolveMinor the highest version with the same major number is used
+	ResolveMinor
+)
+
+// VersionPolicy tells which version to use when the requested version of a driver is missing
+type VersionPolicy int
+
+type semver struct {
+	major int
+	minor int
+	patch int
+}
+
+// parseSemver parses versions like 1, 1.2, v1.2.3 or 1_2_3 as stored in the driver file names
+func parseSemver(version string) (semver, bool) {
+	version = strings.TrimPrefix(strings.ToLower(version), "v")
+	parts := strings.FieldsFunc(version, func(r rune) bool { return r == '.' || r == '_' })
+	if len(parts) == 0 || len(parts) > 3 {
+		return semver{}, false
+	}
+
+	var numbers [3]int
+	for idx, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return semver{}, false
+		}
+		numbers[idx] = n
+	}
+
+	return semver{major: numbers[0], minor: numbers[1], patch: numbers[2]}, true
+}
+
+func (v semver) less(o semver) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	if v.minor != o.minor {
+		return v.minor < o.minor
+	}
+	return v.patch < o.patch
+}
+
+func (v semver) compatible(o semver, policy VersionPolicy) bool {
+	switch policy {
+	case ResolvePatch:
+		return v.major == o.major && v.minor == o.minor
+	case ResolveMinor:
+		return v.major == o.major
+	}
+	return v == o
+}
+
+// resolveVersion returns the highest version compatible with the requested one
+func resolveVersion(versions []string, version string, policy VersionPolicy) (string, bool) {
+	requested, ok := parseSemver(version)
+	if !ok {
+		return "", false
+	}
+
+	var best string
+	var bestSemver semver
+	found := false
+	for _, candidate := range versions {
+		v, ok := parseSemver(candidate)
+		if !ok || !v.compatible(requested, policy) {
+			continue
+		}
+		if !found || bestSemver.less(v) {
+			best, bestSemver, found = candidate, v, true
+		}
+	}
+
+	return best, found
+}
+
+// listVersions returns the versions of the driver id stored in dir, sorted from the oldest to the newest
+// The versions which are not semantic versions are put first, in alphabetical order
+func listVersions(dir string, id string) []string {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Warning("unable to list the drivers from", dir, err)
+		return nil
+	}
+
+	prefix := driverPathRegex.ReplaceAllString(id, "_") + "-"
+	var versions []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		version := strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".json")
+		versions = append(versions, strings.ReplaceAll(version, "_", "."))
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		vi, iOk := parseSemver(versions[i])
+		vj, jOk := parseSemver(versions[j])
+		if iOk && jOk {
+			return vi.less(vj)
+		}
+		if iOk != jOk {
+			return jOk
+		}
+		return versions[i] < versions[j]
+	})
+
+	return versions
+}